@@ -0,0 +1,272 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Approval records someone approving a release for deployment to an environment, until it expires.
+type Approval struct {
+	Component string
+	Version   string
+	Env       string
+	Approver  string
+	Granted   time.Time
+	Expires   time.Time
+	// Revoked is when the approval was revoked, or the zero time if it has not been.
+	Revoked time.Time
+}
+
+// Valid returns whether the approval allows a deployment at the given time.
+func (a *Approval) Valid(now time.Time) bool {
+	return a.Revoked.IsZero() && now.Before(a.Expires)
+}
+
+// ApprovalStore keeps approvals. Revoked approvals are kept, so the store is a record of what was approved.
+type ApprovalStore interface {
+	Grant(approval *Approval) error
+	// List returns approvals, optionally only for a component and/or environment, oldest first.
+	List(component, env string) ([]*Approval, error)
+	// Revoke revokes the valid approvals for a release in an environment.
+	Revoke(component, version, env string) error
+}
+
+// ErrApprovalNotFound is returned when revoking an approval that does not exist.
+var ErrApprovalNotFound = errors.New("approval not found")
+
+type fileApprovalStore struct {
+	path  string
+	mutex sync.Mutex
+}
+
+// CreateFileApprovalStore returns an ApprovalStore that keeps approvals in a local JSON file. Changes are made under
+// a lock on a ".lock" file next to it, so the file can be shared by several processes.
+func CreateFileApprovalStore(path string) ApprovalStore {
+	return &fileApprovalStore{path: path}
+}
+
+// lock takes an exclusive lock on the store, held on a lock file next to it so that other processes sharing the
+// store are locked out as well as other goroutines, returning a function that releases it.
+func (s *fileApprovalStore) lock() (func(), error) {
+	s.mutex.Lock()
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		s.mutex.Unlock()
+		return nil, err
+	}
+	file, err := os.OpenFile(s.path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		s.mutex.Unlock()
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		file.Close()
+		s.mutex.Unlock()
+		return nil, fmt.Errorf("error locking approvals in %s: %s", s.path, err)
+	}
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+		s.mutex.Unlock()
+	}, nil
+}
+
+func (s *fileApprovalStore) read() ([]*Approval, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var approvals []*Approval
+	if err := json.Unmarshal(data, &approvals); err != nil {
+		return nil, fmt.Errorf("error reading approvals from %s: %s", s.path, err)
+	}
+	return approvals, nil
+}
+
+func (s *fileApprovalStore) write(approvals []*Approval) error {
+	data, err := json.MarshalIndent(approvals, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+func (s *fileApprovalStore) Grant(approval *Approval) error {
+	if err := ValidateReleaseKey(approval.Component, approval.Version); err != nil {
+		return err
+	}
+	if approval.Env == "" || approval.Approver == "" {
+		return errors.New("approval must have an env and an approver")
+	}
+	if !approval.Expires.After(approval.Granted) {
+		return errors.New("approval must expire after it is granted")
+	}
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	approvals, err := s.read()
+	if err != nil {
+		return err
+	}
+	return s.write(append(approvals, approval))
+}
+
+func (s *fileApprovalStore) List(component, env string) ([]*Approval, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	approvals, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	var result []*Approval
+	for _, approval := range approvals {
+		if (component == "" || approval.Component == component) && (env == "" || approval.Env == env) {
+			result = append(result, approval)
+		}
+	}
+	return result, nil
+}
+
+func (s *fileApprovalStore) Revoke(component, version, env string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	approvals, err := s.read()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	found := false
+	for _, approval := range approvals {
+		if approval.Component == component && approval.Version == version && approval.Env == env && approval.Valid(now) {
+			approval.Revoked = now
+			found = true
+		}
+	}
+	if !found {
+		return ErrApprovalNotFound
+	}
+	return s.write(approvals)
+}
+
+type approvalGate struct {
+	store ApprovalStore
+	envs  map[string]bool
+}
+
+// CreateApprovalGate returns a DeploymentGate that refuses deployments to the protected environments unless there is
+// a valid approval for the release.
+func CreateApprovalGate(store ApprovalStore, protectedEnvs ...string) DeploymentGate {
+	envs := make(map[string]bool)
+	for _, env := range protectedEnvs {
+		envs[env] = true
+	}
+	return &approvalGate{store: store, envs: envs}
+}
+
+func (g *approvalGate) Check(request *PrepareTerraformRequest) error {
+	if !g.envs[request.EnvName] {
+		return nil
+	}
+	approvals, err := g.store.List(request.Component, request.EnvName)
+	if err != nil {
+		return fmt.Errorf("error checking approvals: %s", err)
+	}
+	now := time.Now()
+	for _, approval := range approvals {
+		if approval.Version == request.Version && approval.Valid(now) {
+			return nil
+		}
+	}
+	return fmt.Errorf(
+		"%s version %s has not been approved for deployment to %s, which is a protected environment",
+		request.Component, request.Version, request.EnvName,
+	)
+}
+
+// Approvals implements an approvals command for a config container's main package, with grant, list and revoke
+// subcommands.
+func Approvals(store ApprovalStore, args []string, output io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: approvals grant|list|revoke [options]")
+	}
+	flags := flag.NewFlagSet("approvals "+args[0], flag.ContinueOnError)
+	flags.SetOutput(output)
+	component := flags.String("component", "", "component of the release")
+	version := flags.String("version", "", "version of the release")
+	env := flags.String("env", "", "environment the release is approved for")
+	approver := flags.String("approver", "", "who approved the release (grant only)")
+	expiresIn := flags.Duration("expires-in", 24*time.Hour, "how long the approval lasts (grant only)")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+
+	switch args[0] {
+	case "grant":
+		now := time.Now().UTC()
+		approval := &Approval{
+			Component: *component,
+			Version:   *version,
+			Env:       *env,
+			Approver:  *approver,
+			Granted:   now,
+			Expires:   now.Add(*expiresIn),
+		}
+		if err := store.Grant(approval); err != nil {
+			return err
+		}
+		fmt.Fprintf(output, "approved %s version %s for %s until %s\n", approval.Component, approval.Version, approval.Env, approval.Expires.Format(time.RFC3339))
+	case "list":
+		approvals, err := store.List(*component, *env)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, approval := range approvals {
+			if *version != "" && approval.Version != *version {
+				continue
+			}
+			status := "valid"
+			if !approval.Revoked.IsZero() {
+				status = "revoked " + approval.Revoked.Format(time.RFC3339)
+			} else if !approval.Valid(now) {
+				status = "expired"
+			}
+			fmt.Fprintf(
+				output, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				approval.Component, approval.Version, approval.Env, approval.Approver,
+				approval.Granted.Format(time.RFC3339), approval.Expires.Format(time.RFC3339), status,
+			)
+		}
+	case "revoke":
+		if err := store.Revoke(*component, *version, *env); err != nil {
+			return err
+		}
+		fmt.Fprintf(output, "revoked approval of %s version %s for %s\n", *component, *version, *env)
+	default:
+		return fmt.Errorf("unknown approvals command %q, expected grant, list or revoke", args[0])
+	}
+	return nil
+}
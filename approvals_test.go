@@ -0,0 +1,118 @@
+package common_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func TestApprovals(t *testing.T) {
+	// Given
+	dir, err := ioutil.TempDir("", "cdflow2-config-common-test-approvals")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	defer os.RemoveAll(dir)
+	store := common.CreateFileApprovalStore(filepath.Join(dir, "approvals.json"))
+	handler := common.CreateGatedHandler(&stubHandler{}, common.CreateApprovalGate(store, "live"))
+	deploy := func(env string) error {
+		return handler.PrepareTerraform(prepareTerraformRequest("test-component", "1", env), common.CreatePrepareTerraformResponse(), "")
+	}
+
+	// When
+	unprotected := deploy("aslive")
+	unapproved := deploy("live")
+	var output bytes.Buffer
+	if err := common.Approvals(store, []string{"grant", "-component", "test-component", "-version", "1", "-env", "live", "-approver", "jo"}, &output); err != nil {
+		t.Fatal("error granting approval:", err)
+	}
+	approved := deploy("live")
+	if err := common.Approvals(store, []string{"revoke", "-component", "test-component", "-version", "1", "-env", "live"}, &output); err != nil {
+		t.Fatal("error revoking approval:", err)
+	}
+	revoked := deploy("live")
+	if err := common.Approvals(store, []string{"list", "-env", "live"}, &output); err != nil {
+		t.Fatal("error listing approvals:", err)
+	}
+
+	// Then
+	if unprotected != nil {
+		t.Fatal("expected unprotected deployment to be allowed:", unprotected)
+	}
+	if unapproved == nil || !strings.Contains(unapproved.Error(), "test-component version 1 has not been approved for deployment to live") {
+		t.Fatalf("unexpected error: %v", unapproved)
+	}
+	if approved != nil {
+		t.Fatal("expected approved deployment to be allowed:", approved)
+	}
+	if revoked == nil {
+		t.Fatal("expected deployment to be refused after the approval was revoked")
+	}
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[2], "test-component\t1\tlive\tjo\t") || !strings.Contains(lines[2], "\trevoked ") {
+		t.Fatalf("unexpected output: %q", output.String())
+	}
+}
+
+func TestApprovalsRejectsExpiredGrant(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cdflow2-config-common-test-approvals")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	defer os.RemoveAll(dir)
+	store := common.CreateFileApprovalStore(filepath.Join(dir, "approvals.json"))
+	args := []string{"grant", "-component", "test-component", "-version", "1", "-env", "live", "-approver", "jo", "-expires-in", "-1h"}
+	if err := common.Approvals(store, args, ioutil.Discard); err == nil {
+		t.Fatal("expected error granting an approval that has already expired")
+	}
+}
+
+func TestFileApprovalStoreConcurrentGrants(t *testing.T) {
+	// Given
+	dir, err := ioutil.TempDir("", "cdflow2-config-common-test-approvals")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "approvals.json")
+	const grants = 20
+
+	// When - each grant goes through its own store, as separate processes would
+	var wg sync.WaitGroup
+	for i := 0; i < grants; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			now := time.Now().UTC()
+			approval := &common.Approval{
+				Component: "test-component",
+				Version:   fmt.Sprint(i),
+				Env:       "live",
+				Approver:  "jo",
+				Granted:   now,
+				Expires:   now.Add(time.Hour),
+			}
+			if err := common.CreateFileApprovalStore(path).Grant(approval); err != nil {
+				t.Error("error granting approval:", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Then
+	approvals, err := common.CreateFileApprovalStore(path).List("", "")
+	if err != nil {
+		t.Fatal("error listing approvals:", err)
+	}
+	if len(approvals) != grants {
+		t.Fatalf("expected %d approvals, got %d", grants, len(approvals))
+	}
+}
@@ -0,0 +1,489 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ReleaseFormat is an archive format that a release can be stored in.
+type ReleaseFormat interface {
+	// Extension returns the conventional file extension for the format, e.g. "zip" or "tar.zst".
+	Extension() string
+	matches(header []byte) bool
+	newWriter(writer io.Writer) (releaseArchiveWriter, error)
+	newReader(reader io.Reader) (releaseArchiveReader, error)
+}
+
+// releaseArchiveWriter writes entries to a release archive.
+type releaseArchiveWriter interface {
+	writeDir(name string, info os.FileInfo) error
+	writeSymlink(name, target string, info os.FileInfo) error
+	writeFile(name string, info os.FileInfo, reader io.Reader) error
+	Close() error
+}
+
+// releaseArchiveEntry is a single entry read from a release archive.
+type releaseArchiveEntry struct {
+	name   string
+	info   os.FileInfo
+	target string
+	reader io.Reader
+}
+
+// releaseArchiveReader reads entries from a release archive, returning io.EOF after the last one.
+type releaseArchiveReader interface {
+	next() (*releaseArchiveEntry, error)
+	Close() error
+}
+
+const (
+	terraformImageName = "terraform-image"
+	releaseInfoName    = "release.json"
+)
+
+// ErrNoReleaseInfo is returned by ReadReleaseInfo for releases archived without release info.
+var ErrNoReleaseInfo = errors.New("release does not contain " + releaseInfoName)
+
+// releaseFormats are the formats UnzipRelease can detect.
+var releaseFormats = []ReleaseFormat{ZipFormat, TarGzipFormat, TarZstdFormat}
+
+const releaseFormatHeaderSize = 4
+
+// DetectReleaseFormat works out the format of a release from its magic bytes, returning a reader that includes the bytes used to detect it.
+func DetectReleaseFormat(reader io.Reader) (ReleaseFormat, io.Reader, error) {
+	bufferedReader := bufio.NewReader(reader)
+	header, err := bufferedReader.Peek(releaseFormatHeaderSize)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	for _, format := range releaseFormats {
+		if format.matches(header) {
+			return format, bufferedReader, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("unrecognised release format, header: %x", header)
+}
+
+// ZipRelease zips the release folder to a stream.
+func ZipRelease(
+	writer io.Writer, dir, component, version, terraformImage string,
+) error {
+	return ArchiveRelease(writer, ZipFormat, dir, &ReleaseInfo{
+		Component:      component,
+		Version:        version,
+		TerraformImage: terraformImage,
+	})
+}
+
+// ArchiveRelease writes the release folder to a stream in the given format, along with the release info as release.json.
+func ArchiveRelease(
+	writer io.Writer, format ReleaseFormat, dir string, releaseInfo *ReleaseInfo,
+) error {
+	if releaseInfo.Component == "" {
+		panic("no component")
+	}
+	prefix := releaseInfo.Component + "-" + releaseInfo.Version
+	archiveWriter, err := format.newWriter(writer)
+	if err != nil {
+		return err
+	}
+	terraformImageFilename := filepath.Join(prefix, terraformImageName)
+	if err := archiveWriter.writeFile(
+		terraformImageFilename,
+		dummyFileInfo{size: int64(len(releaseInfo.TerraformImage)), mode: 0644},
+		strings.NewReader(releaseInfo.TerraformImage),
+	); err != nil {
+		return err
+	}
+	releaseInfoData, err := json.MarshalIndent(releaseInfo, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := archiveWriter.writeFile(
+		filepath.Join(prefix, releaseInfoName),
+		dummyFileInfo{size: int64(len(releaseInfoData)), mode: 0644},
+		bytes.NewReader(releaseInfoData),
+	); err != nil {
+		return err
+	}
+
+	symlinks := make(releaseSymlinks)
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		if relativePath == "." {
+			return nil
+		}
+
+		if relativePath == UploadStateDirName {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if relativePath == terraformImageName || relativePath == releaseInfoName {
+			return fmt.Errorf("%s is reserved and cannot be included in the release", relativePath)
+		}
+
+		name := filepath.Join(prefix, relativePath)
+
+		if info.IsDir() {
+			return archiveWriter.writeDir(name, info)
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := symlinks.add(relativePath, target); err != nil {
+				return err
+			}
+			return archiveWriter.writeSymlink(name, target, info)
+		}
+
+		reader, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("cdflow2-config-common: error opening %s for reading: %s", path, err)
+		}
+
+		defer reader.Close()
+
+		return archiveWriter.writeFile(name, info, reader)
+	}); err != nil {
+		return err
+	}
+	if err := symlinks.check(); err != nil {
+		return err
+	}
+
+	return archiveWriter.Close()
+}
+
+// maxSymlinkHops limits how many symlinks are followed resolving a path in a release, as in the kernel's ELOOP.
+const maxSymlinkHops = 40
+
+// releaseSymlinks are the symlinks in a release by path within it, so they can be checked to resolve inside the
+// release, including through other symlinks.
+type releaseSymlinks map[string]string
+
+// add records a symlink at relativePath within a release, refusing absolute targets and targets that are outside of the
+// release on their own.
+func (s releaseSymlinks) add(relativePath, target string) error {
+	if filepath.IsAbs(target) {
+		return fmt.Errorf("symlink %q has absolute target %q, only relative targets within the release are allowed", relativePath, target)
+	}
+	resolved := filepath.Clean(filepath.Join(filepath.Dir(relativePath), target))
+	if resolved == ".." || strings.HasPrefix(resolved, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("symlink %q has target %q outside of the release", relativePath, target)
+	}
+	s[filepath.ToSlash(relativePath)] = filepath.ToSlash(target)
+	return nil
+}
+
+// check resolves every symlink, following the other symlinks in the release, returning an error for the first that
+// resolves outside of the release or does not resolve.
+func (s releaseSymlinks) check() error {
+	for _, path := range sortedStringKeys(s) {
+		if err := s.resolve(path); err != nil {
+			return fmt.Errorf("symlink %q has target %q %s", path, s[path], err)
+		}
+	}
+	return nil
+}
+
+// resolve follows the symlinks in a path as the kernel would, but only looking at the symlinks in the release, returning
+// an error if the path goes above the root of the release.
+func (s releaseSymlinks) resolve(path string) error {
+	var resolved []string
+	pending := strings.Split(path, "/")
+	hops := 0
+	for len(pending) > 0 {
+		component := pending[0]
+		pending = pending[1:]
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return errors.New("outside of the release")
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+		target, ok := s[strings.Join(append(resolved, component), "/")]
+		if !ok {
+			resolved = append(resolved, component)
+			continue
+		}
+		if hops++; hops > maxSymlinkHops {
+			return errors.New("that loops")
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	return nil
+}
+
+type dummyFileInfo struct {
+	size int64
+	mode os.FileMode
+}
+
+func (dummyFileInfo) Name() string {
+	return ""
+}
+
+func (d dummyFileInfo) Size() int64 {
+	return d.size
+}
+
+func (d dummyFileInfo) Mode() os.FileMode {
+	return d.mode
+}
+
+func (dummyFileInfo) ModTime() time.Time {
+	return time.Now()
+}
+
+func (dummyFileInfo) IsDir() bool {
+	return false
+}
+
+func (dummyFileInfo) Sys() interface{} {
+	return nil
+}
+
+// UnzipRelease unpacks the release, detecting the archive format from its contents.
+func UnzipRelease(
+	reader io.Reader, dir, component, version string,
+) (string, error) {
+	releaseInfo, err := UnpackRelease(reader, dir, component, version)
+	if err != nil {
+		return "", err
+	}
+	return releaseInfo.TerraformImage, nil
+}
+
+// UnpackRelease unpacks the release, returning the release info stored in it.
+//
+// Releases archived before release.json was added only have the component, version and terraform image set.
+func UnpackRelease(
+	reader io.Reader, dir, component, version string,
+) (*ReleaseInfo, error) {
+	archiveReader, err := openReleaseArchive(reader)
+	if err != nil {
+		return nil, err
+	}
+	defer archiveReader.Close()
+
+	prefix := component + "-" + version
+
+	releaseInfo := &ReleaseInfo{Component: component, Version: version}
+	symlinks := make(releaseSymlinks)
+	var terraformImageBuffer bytes.Buffer
+	for {
+		entry, err := archiveReader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		parts, err := splitReleaseEntryName(entry.name)
+		if err != nil {
+			return nil, err
+		}
+		if parts[0] != prefix {
+			return nil, fmt.Errorf("error in release archive, expected prefix \"%v\", got \"%v\"", prefix, parts[0])
+		}
+
+		if len(parts) == 2 && parts[1] == terraformImageName {
+			io.Copy(&terraformImageBuffer, entry.reader)
+			continue
+		}
+
+		if len(parts) == 2 && parts[1] == releaseInfoName {
+			if err := json.NewDecoder(entry.reader).Decode(releaseInfo); err != nil {
+				return nil, fmt.Errorf("error in release archive, could not parse %s: %s", releaseInfoName, err)
+			}
+			continue
+		}
+
+		relativePath, destFilename, err := releaseEntryPath(dir, parts[1:])
+		if err != nil {
+			return nil, fmt.Errorf("error in release archive: %s", err)
+		}
+		if entry.info.IsDir() {
+			if err := os.MkdirAll(destFilename, os.FileMode(0755)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if entry.info.Mode()&os.ModeSymlink != 0 {
+			if err := unpackSymlink(symlinks, entry.target, relativePath, destFilename); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := unpackFile(entry, destFilename); err != nil {
+			return nil, err
+		}
+	}
+	// read to the end, since tar archives end before their compressed stream does and readers that verify a checksum
+	// only do so at the end - closing the archive first, as decompressors may read ahead in the background
+	if err := archiveReader.Close(); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+		return nil, err
+	}
+	if err := symlinks.check(); err != nil {
+		// the links are only safe together, so remove them all
+		for path := range symlinks {
+			os.Remove(filepath.Join(dir, filepath.FromSlash(path)))
+		}
+		return nil, fmt.Errorf("error in release archive: %s", err)
+	}
+	if terraformImageBuffer.String() == "" {
+		panic("did not find terraform-image in release")
+	}
+	releaseInfo.TerraformImage = terraformImageBuffer.String()
+	return releaseInfo, nil
+}
+
+// ReadReleaseInfo returns the release info stored in a release without extracting it.
+func ReadReleaseInfo(reader io.Reader) (*ReleaseInfo, error) {
+	archiveReader, err := openReleaseArchive(reader)
+	if err != nil {
+		return nil, err
+	}
+	defer archiveReader.Close()
+
+	for {
+		entry, err := archiveReader.next()
+		if err == io.EOF {
+			return nil, ErrNoReleaseInfo
+		}
+		if err != nil {
+			return nil, err
+		}
+		parts, err := splitReleaseEntryName(entry.name)
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) == 2 && parts[1] == releaseInfoName {
+			var releaseInfo ReleaseInfo
+			if err := json.NewDecoder(entry.reader).Decode(&releaseInfo); err != nil {
+				return nil, fmt.Errorf("error in release archive, could not parse %s: %s", releaseInfoName, err)
+			}
+			return &releaseInfo, nil
+		}
+	}
+}
+
+func openReleaseArchive(reader io.Reader) (releaseArchiveReader, error) {
+	format, reader, err := DetectReleaseFormat(reader)
+	if err != nil {
+		return nil, err
+	}
+	return format.newReader(reader)
+}
+
+func splitReleaseEntryName(name string) ([]string, error) {
+	if name[0] == '/' {
+		return nil, fmt.Errorf("error in release archive, unexpected absolute path \"%v\"", name)
+	}
+	return strings.Split(name, "/"), nil
+}
+
+// releaseEntryPath returns the path of an entry relative to the release and where to unpack it in dir, refusing entries
+// that would be written outside of dir - through a ".." segment, or through a symlink unpacked by an earlier entry.
+func releaseEntryPath(dir string, parts []string) (string, string, error) {
+	for _, part := range parts {
+		if part == ".." {
+			return "", "", fmt.Errorf("entry %q is outside of the release", strings.Join(parts, "/"))
+		}
+	}
+	relativePath := filepath.Join(parts...)
+	if relativePath == "" {
+		return relativePath, dir, nil
+	}
+	current := dir
+	components := strings.Split(relativePath, string(filepath.Separator))
+	for _, component := range components[:len(components)-1] {
+		current = filepath.Join(current, component)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", "", fmt.Errorf("entry %q is inside symlink %q", relativePath, strings.TrimPrefix(current, dir+string(filepath.Separator)))
+		}
+	}
+	return relativePath, filepath.Join(dir, relativePath), nil
+}
+
+func unpackFile(entry *releaseArchiveEntry, destFilename string) error {
+	if err := os.MkdirAll(filepath.Dir(destFilename), os.FileMode(0755)); err != nil {
+		return err
+	}
+	// replace rather than write through an existing symlink
+	if info, err := os.Lstat(destFilename); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(destFilename); err != nil {
+			return err
+		}
+	}
+	writer, err := os.OpenFile(destFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, entry.info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	if _, err := io.Copy(writer, entry.reader); err != nil {
+		return err
+	}
+	return nil
+}
+
+// unpackSymlink recreates a symlink stored in a release, refusing targets outside of the release. Targets that are only
+// outside of the release through other symlinks are found by checking symlinks once the release is unpacked.
+func unpackSymlink(symlinks releaseSymlinks, target, relativePath, destFilename string) error {
+	if err := symlinks.add(relativePath, target); err != nil {
+		return fmt.Errorf("error in release archive: %s", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(destFilename), os.FileMode(0755)); err != nil {
+		return err
+	}
+	if err := os.Remove(destFilename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(target, destFilename)
+}
+
+// readSymlinkTarget reads a symlink target for formats that store it as the entry contents.
+func readSymlinkTarget(reader io.Reader) (string, error) {
+	target, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	return string(target), nil
+}
@@ -0,0 +1,289 @@
+package common
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// StateFileName is the name of the state file at the end of a state key.
+const StateFileName = "terraform.tfstate"
+
+// SecretDisplayValue is the DisplayValue given to secret backend config parameters.
+const SecretDisplayValue = "********"
+
+// TerraformBackend configures the terraform backend in a prepare terraform response.
+type TerraformBackend interface {
+	Configure(request *PrepareTerraformRequest, response *PrepareTerraformResponse) error
+}
+
+// StatePrefix returns the prefix for the state of a component in an environment, {team}/{component}/{env}, which every
+// backend uses so that state is laid out the same way whichever config container deployed it.
+func StatePrefix(team, component, env string) (string, error) {
+	var missing []string
+	for _, part := range []struct{ name, value string }{{"team", team}, {"component", component}, {"env", env}} {
+		if part.value == "" {
+			missing = append(missing, part.name)
+		} else if part.value == "." || part.value == ".." || strings.ContainsAny(part.value, "/\\") {
+			return "", fmt.Errorf("invalid %s %q for terraform state key", part.name, part.value)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("terraform state key needs %s", strings.Join(missing, ", "))
+	}
+	return team + "/" + component + "/" + env, nil
+}
+
+// StateKey returns the key of the state file for a component in an environment, {team}/{component}/{env}/terraform.tfstate.
+func StateKey(team, component, env string) (string, error) {
+	prefix, err := StatePrefix(team, component, env)
+	if err != nil {
+		return "", err
+	}
+	return prefix + "/" + StateFileName, nil
+}
+
+// backendConfig collects the settings of a backend, checking required settings and keeping secrets apart.
+type backendConfig struct {
+	name       string
+	config     map[string]string
+	parameters map[string]*TerraformBackendConfigParameter
+	missing    []string
+}
+
+func newBackendConfig(name string) *backendConfig {
+	return &backendConfig{
+		name:       name,
+		config:     make(map[string]string),
+		parameters: make(map[string]*TerraformBackendConfigParameter),
+	}
+}
+
+func (c *backendConfig) required(key, value string) {
+	if value == "" {
+		c.missing = append(c.missing, key)
+		return
+	}
+	c.config[key] = value
+}
+
+func (c *backendConfig) optional(key, value string) {
+	if value != "" {
+		c.config[key] = value
+	}
+}
+
+func (c *backendConfig) secret(key, value string) {
+	if value != "" {
+		c.parameters[key] = &TerraformBackendConfigParameter{Value: value, DisplayValue: SecretDisplayValue}
+	}
+}
+
+func (c *backendConfig) requiredSecret(key, value string) {
+	if value == "" {
+		c.missing = append(c.missing, key)
+		return
+	}
+	c.secret(key, value)
+}
+
+// joinStatePath returns the path under base, or "" if base is not set, so it is reported as missing.
+func joinStatePath(base, path string) string {
+	if base == "" {
+		return ""
+	}
+	return strings.TrimSuffix(base, "/") + "/" + path
+}
+
+// apply sets the backend in the response, or returns an error listing the missing settings.
+func (c *backendConfig) apply(response *PrepareTerraformResponse) error {
+	if len(c.missing) > 0 {
+		return fmt.Errorf("%s backend is missing required settings: %s", c.name, strings.Join(c.missing, ", "))
+	}
+	response.TerraformBackendType = c.name
+	if response.TerraformBackendConfig == nil {
+		response.TerraformBackendConfig = make(map[string]string)
+	}
+	if response.TerraformBackendConfigParameters == nil {
+		response.TerraformBackendConfigParameters = make(map[string]*TerraformBackendConfigParameter)
+	}
+	for key, value := range c.config {
+		response.TerraformBackendConfig[key] = value
+		delete(response.TerraformBackendConfigParameters, key)
+	}
+	for key, parameter := range c.parameters {
+		response.TerraformBackendConfigParameters[key] = parameter
+		delete(response.TerraformBackendConfig, key)
+	}
+	return nil
+}
+
+// S3Backend stores state in an S3 bucket, at the StateKey.
+type S3Backend struct {
+	Bucket        string
+	Region        string
+	DynamoDBTable string
+	Encrypt       bool
+	AccessKey     string
+	SecretKey     string
+	SessionToken  string
+}
+
+// Configure sets the s3 backend in the response.
+func (b *S3Backend) Configure(request *PrepareTerraformRequest, response *PrepareTerraformResponse) error {
+	key, err := StateKey(request.Team, request.Component, request.EnvName)
+	if err != nil {
+		return err
+	}
+	config := newBackendConfig("s3")
+	config.required("bucket", b.Bucket)
+	config.required("region", b.Region)
+	config.required("key", key)
+	config.optional("dynamodb_table", b.DynamoDBTable)
+	if b.Encrypt {
+		config.optional("encrypt", "true")
+	}
+	if (b.AccessKey == "") != (b.SecretKey == "") {
+		return fmt.Errorf("s3 backend needs both or neither of access_key and secret_key")
+	}
+	config.secret("access_key", b.AccessKey)
+	config.secret("secret_key", b.SecretKey)
+	config.secret("token", b.SessionToken)
+	return config.apply(response)
+}
+
+// GCSBackend stores state in a Google Cloud Storage bucket, under the StatePrefix.
+type GCSBackend struct {
+	Bucket      string
+	Credentials string
+}
+
+// Configure sets the gcs backend in the response.
+func (b *GCSBackend) Configure(request *PrepareTerraformRequest, response *PrepareTerraformResponse) error {
+	prefix, err := StatePrefix(request.Team, request.Component, request.EnvName)
+	if err != nil {
+		return err
+	}
+	config := newBackendConfig("gcs")
+	config.required("bucket", b.Bucket)
+	config.required("prefix", prefix)
+	config.secret("credentials", b.Credentials)
+	return config.apply(response)
+}
+
+// AzureRMBackend stores state in an Azure storage container, at the StateKey.
+type AzureRMBackend struct {
+	StorageAccountName string
+	ContainerName      string
+	ResourceGroupName  string
+	AccessKey          string
+	SASToken           string
+	ClientSecret       string
+}
+
+// Configure sets the azurerm backend in the response.
+func (b *AzureRMBackend) Configure(request *PrepareTerraformRequest, response *PrepareTerraformResponse) error {
+	key, err := StateKey(request.Team, request.Component, request.EnvName)
+	if err != nil {
+		return err
+	}
+	config := newBackendConfig("azurerm")
+	config.required("storage_account_name", b.StorageAccountName)
+	config.required("container_name", b.ContainerName)
+	config.required("key", key)
+	config.optional("resource_group_name", b.ResourceGroupName)
+	config.secret("access_key", b.AccessKey)
+	config.secret("sas_token", b.SASToken)
+	config.secret("client_secret", b.ClientSecret)
+	return config.apply(response)
+}
+
+// HTTPBackend stores state with a REST service, at the StatePrefix under BaseURL (and LockBaseURL, if set).
+type HTTPBackend struct {
+	BaseURL     string
+	LockBaseURL string
+	Username    string
+	Password    string
+}
+
+// Configure sets the http backend in the response.
+func (b *HTTPBackend) Configure(request *PrepareTerraformRequest, response *PrepareTerraformResponse) error {
+	prefix, err := StatePrefix(request.Team, request.Component, request.EnvName)
+	if err != nil {
+		return err
+	}
+	config := newBackendConfig("http")
+	config.required("address", joinStatePath(b.BaseURL, prefix))
+	config.optional("lock_address", joinStatePath(b.LockBaseURL, prefix))
+	config.optional("unlock_address", joinStatePath(b.LockBaseURL, prefix))
+	config.optional("username", b.Username)
+	config.secret("password", b.Password)
+	return config.apply(response)
+}
+
+// ConsulBackend stores state in Consul's KV store, at the StatePrefix.
+type ConsulBackend struct {
+	Address     string
+	Scheme      string
+	AccessToken string
+}
+
+// Configure sets the consul backend in the response.
+func (b *ConsulBackend) Configure(request *PrepareTerraformRequest, response *PrepareTerraformResponse) error {
+	prefix, err := StatePrefix(request.Team, request.Component, request.EnvName)
+	if err != nil {
+		return err
+	}
+	config := newBackendConfig("consul")
+	config.required("address", b.Address)
+	config.required("path", prefix)
+	config.optional("scheme", b.Scheme)
+	config.secret("access_token", b.AccessToken)
+	return config.apply(response)
+}
+
+var invalidSchemaNameChars = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// maxSchemaNameLength is the longest identifier Postgres allows, in bytes - longer names are truncated.
+const maxSchemaNameLength = 63
+
+// PGBackend stores state in a Postgres database, in a schema named after the StatePrefix followed by a hash of it, so
+// that prefixes that only differ in punctuation or case get different schemas, e.g. team_component_env_1a2b3c4d.
+type PGBackend struct {
+	// ConnStr is the connection string, which is treated as a secret since it usually includes a password.
+	ConnStr string
+}
+
+// Configure sets the pg backend in the response.
+func (b *PGBackend) Configure(request *PrepareTerraformRequest, response *PrepareTerraformResponse) error {
+	prefix, err := StatePrefix(request.Team, request.Component, request.EnvName)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256([]byte(prefix))
+	schemaName := fmt.Sprintf("%s_%x", invalidSchemaNameChars.ReplaceAllString(strings.ToLower(prefix), "_"), hash[:4])
+	if len(schemaName) > maxSchemaNameLength {
+		return fmt.Errorf("pg schema name %q for %s is longer than %d characters", schemaName, prefix, maxSchemaNameLength)
+	}
+	config := newBackendConfig("pg")
+	config.requiredSecret("conn_str", b.ConnStr)
+	config.required("schema_name", schemaName)
+	return config.apply(response)
+}
+
+// LocalBackend stores state in a local directory, at the StateKey under Dir.
+type LocalBackend struct {
+	Dir string
+}
+
+// Configure sets the local backend in the response.
+func (b *LocalBackend) Configure(request *PrepareTerraformRequest, response *PrepareTerraformResponse) error {
+	key, err := StateKey(request.Team, request.Component, request.EnvName)
+	if err != nil {
+		return err
+	}
+	config := newBackendConfig("local")
+	config.required("path", joinStatePath(b.Dir, key))
+	return config.apply(response)
+}
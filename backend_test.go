@@ -0,0 +1,171 @@
+package common_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func TestTerraformBackends(t *testing.T) {
+	for _, test := range []struct {
+		backend            common.TerraformBackend
+		expectedType       string
+		expectedConfig     map[string]string
+		expectedParameters []string
+	}{
+		{
+			backend: &common.S3Backend{
+				Bucket: "test-bucket", Region: "eu-west-1", DynamoDBTable: "test-locks", Encrypt: true,
+				AccessKey: "test-access-key", SecretKey: "test-secret-key",
+			},
+			expectedType: "s3",
+			expectedConfig: map[string]string{
+				"bucket": "test-bucket", "region": "eu-west-1", "dynamodb_table": "test-locks", "encrypt": "true",
+				"key": "test-team/test-component/live/terraform.tfstate",
+			},
+			expectedParameters: []string{"access_key", "secret_key"},
+		},
+		{
+			backend:            &common.GCSBackend{Bucket: "test-bucket", Credentials: `{"type": "service_account"}`},
+			expectedType:       "gcs",
+			expectedConfig:     map[string]string{"bucket": "test-bucket", "prefix": "test-team/test-component/live"},
+			expectedParameters: []string{"credentials"},
+		},
+		{
+			backend: &common.AzureRMBackend{
+				StorageAccountName: "testaccount", ContainerName: "tfstate", SASToken: "test-sas-token",
+			},
+			expectedType: "azurerm",
+			expectedConfig: map[string]string{
+				"storage_account_name": "testaccount", "container_name": "tfstate",
+				"key": "test-team/test-component/live/terraform.tfstate",
+			},
+			expectedParameters: []string{"sas_token"},
+		},
+		{
+			backend: &common.HTTPBackend{
+				BaseURL: "https://state.example.com/", LockBaseURL: "https://state.example.com/lock",
+				Username: "deployer", Password: "test-password",
+			},
+			expectedType: "http",
+			expectedConfig: map[string]string{
+				"address":        "https://state.example.com/test-team/test-component/live",
+				"lock_address":   "https://state.example.com/lock/test-team/test-component/live",
+				"unlock_address": "https://state.example.com/lock/test-team/test-component/live",
+				"username":       "deployer",
+			},
+			expectedParameters: []string{"password"},
+		},
+		{
+			backend:            &common.ConsulBackend{Address: "consul:8500", AccessToken: "test-token"},
+			expectedType:       "consul",
+			expectedConfig:     map[string]string{"address": "consul:8500", "path": "test-team/test-component/live"},
+			expectedParameters: []string{"access_token"},
+		},
+		{
+			backend:            &common.PGBackend{ConnStr: "postgres://user:test-password@db/state"},
+			expectedType:       "pg",
+			expectedConfig:     map[string]string{"schema_name": "test_team_test_component_live_c5560fe3"},
+			expectedParameters: []string{"conn_str"},
+		},
+		{
+			backend:        &common.LocalBackend{Dir: "/state"},
+			expectedType:   "local",
+			expectedConfig: map[string]string{"path": "/state/test-team/test-component/live/terraform.tfstate"},
+		},
+	} {
+		t.Run(test.expectedType, func(t *testing.T) {
+			// Given
+			request := prepareTerraformRequest("test-component", "1", "live")
+			response := common.CreatePrepareTerraformResponse()
+
+			// When
+			if err := test.backend.Configure(request, response); err != nil {
+				t.Fatal("error configuring backend:", err)
+			}
+
+			// Then
+			if response.TerraformBackendType != test.expectedType {
+				t.Fatalf("got type %q, wanted %q", response.TerraformBackendType, test.expectedType)
+			}
+			if !reflect.DeepEqual(response.TerraformBackendConfig, test.expectedConfig) {
+				t.Fatalf("got config %v, wanted %v", response.TerraformBackendConfig, test.expectedConfig)
+			}
+			if len(response.TerraformBackendConfigParameters) != len(test.expectedParameters) {
+				t.Fatalf("got parameters %v, wanted %v", response.TerraformBackendConfigParameters, test.expectedParameters)
+			}
+			for _, key := range test.expectedParameters {
+				parameter := response.TerraformBackendConfigParameters[key]
+				if parameter == nil || parameter.Value == "" || parameter.DisplayValue != common.SecretDisplayValue {
+					t.Fatalf("expected masked parameter %s, got %+v", key, parameter)
+				}
+			}
+			response.TerraformImage = "test-terraform-image"
+			if err := common.ValidatePrepareTerraformResponse(response); err != nil {
+				t.Fatal("invalid response:", err)
+			}
+		})
+	}
+}
+
+func TestTerraformBackendMissingSettings(t *testing.T) {
+	request := prepareTerraformRequest("test-component", "1", "live")
+	err := (&common.S3Backend{AccessKey: "test-access-key", SecretKey: "test-secret-key"}).Configure(request, common.CreatePrepareTerraformResponse())
+	expected := "s3 backend is missing required settings: bucket, region"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("got %v, wanted %q", err, expected)
+	}
+	err = (&common.S3Backend{Bucket: "test-bucket", Region: "eu-west-1", AccessKey: "test-access-key"}).Configure(request, common.CreatePrepareTerraformResponse())
+	if err == nil {
+		t.Fatal("expected error for access key without secret key")
+	}
+	err = (&common.PGBackend{}).Configure(request, common.CreatePrepareTerraformResponse())
+	if err == nil || err.Error() != "pg backend is missing required settings: conn_str" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestStateKey(t *testing.T) {
+	key, err := common.StateKey("test-team", "test-component", "live")
+	if err != nil || key != "test-team/test-component/live/terraform.tfstate" {
+		t.Fatalf("got %q, error: %v", key, err)
+	}
+	if _, err := common.StateKey("test-team", "", ""); err == nil || err.Error() != "terraform state key needs component, env" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := common.StateKey("test-team", "../other", "live"); err == nil {
+		t.Fatal("expected error for component with a slash")
+	}
+}
+
+func TestPGBackendSchemaName(t *testing.T) {
+	// Given
+	schemaName := func(team, component, env string) (string, error) {
+		request := prepareTerraformRequest(component, "1", env)
+		request.Team = team
+		response := common.CreatePrepareTerraformResponse()
+		err := (&common.PGBackend{ConnStr: "postgres://db/state"}).Configure(request, response)
+		return response.TerraformBackendConfig["schema_name"], err
+	}
+
+	// When
+	names := make(map[string]bool)
+	for _, prefix := range [][3]string{{"a-b", "c", "live"}, {"a", "b-c", "live"}, {"a", "b_c", "live"}, {"A", "b_c", "live"}} {
+		name, err := schemaName(prefix[0], prefix[1], prefix[2])
+		if err != nil {
+			t.Fatal("error configuring pg backend:", err)
+		}
+		names[name] = true
+	}
+	_, err := schemaName("test-team", strings.Repeat("c", 40), "live")
+
+	// Then
+	if len(names) != 4 {
+		t.Fatalf("expected a different schema for each prefix, got %v", names)
+	}
+	if err == nil || !strings.Contains(err.Error(), "is longer than 63 characters") {
+		t.Fatalf("expected error for a long schema name, got %v", err)
+	}
+}
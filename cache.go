@@ -0,0 +1,261 @@
+package common
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cachingReleaseStore keeps a copy of each release it gets on local disk, laid out as:
+//
+//	blobs/{sha256}                  release archives, addressed by their content
+//	index/{component}/{version}     the sha256 of the archive for a release
+//
+// Blobs and index entries are written atomically, so several processes can share a cache directory. Releases are
+// assumed not to change once uploaded - a Put or Delete through the cache invalidates the cached copy.
+type cachingReleaseStore struct {
+	ReleaseStore
+	dir     string
+	maxSize int64
+	mutex   sync.Mutex
+	locks   map[string]*sync.Mutex
+}
+
+// maxCacheFetchAttempts limits how many times a release is fetched when concurrent loads keep evicting it.
+const maxCacheFetchAttempts = 3
+
+// CreateCachingReleaseStore returns a ReleaseStore that caches releases got from another store in a local directory,
+// evicting the least recently used releases when the cache grows beyond maxSize bytes. A maxSize of zero or less
+// disables eviction. The returned store does not implement ChunkedReleaseStore, so use the underlying store for uploads.
+func CreateCachingReleaseStore(store ReleaseStore, dir string, maxSize int64) ReleaseStore {
+	return &cachingReleaseStore{
+		ReleaseStore: store,
+		dir:          dir,
+		maxSize:      maxSize,
+		locks:        make(map[string]*sync.Mutex),
+	}
+}
+
+// lock serialises access to a release, so concurrent loads of the same version only download it once.
+func (c *cachingReleaseStore) lock(component, version string) func() {
+	key := component + "/" + version
+	c.mutex.Lock()
+	lock, ok := c.locks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		c.locks[key] = lock
+	}
+	c.mutex.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+func (c *cachingReleaseStore) indexPath(component, version string) string {
+	return filepath.Join(c.dir, "index", component, version)
+}
+
+func (c *cachingReleaseStore) blobPath(checksum string) string {
+	return filepath.Join(c.dir, "blobs", checksum)
+}
+
+// Get returns the cached release if there is one, otherwise gets it from the store and caches it. The cached copy is
+// verified against its checksum before it is returned, and refetched if it does not match.
+func (c *cachingReleaseStore) Get(component, version string) (io.ReadCloser, error) {
+	if err := ValidateReleaseKey(component, version); err != nil {
+		return nil, err
+	}
+	unlock := c.lock(component, version)
+	defer unlock()
+
+	if release, err := c.openCached(component, version); err != nil || release != nil {
+		return release, err
+	}
+	for attempt := 1; ; attempt++ {
+		checksum, err := c.fetch(component, version)
+		if err != nil {
+			return nil, err
+		}
+		// open before evicting, so the blob can be read even if a concurrent load evicts it
+		release, err := c.openBlob(checksum)
+		if os.IsNotExist(err) && attempt < maxCacheFetchAttempts {
+			// evicted by a concurrent load of another release before it could be opened
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := c.evict(checksum); err != nil {
+			release.Close()
+			return nil, err
+		}
+		return release, nil
+	}
+}
+
+// openCached returns the cached release, or nil if it is not cached or the cached copy is corrupt.
+func (c *cachingReleaseStore) openCached(component, version string) (io.ReadCloser, error) {
+	data, err := ioutil.ReadFile(c.indexPath(component, version))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	checksum := strings.TrimSpace(string(data))
+	if valid, err := c.verifyBlob(checksum); err != nil || !valid {
+		return nil, err
+	}
+	release, err := c.openBlob(checksum)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	os.Chtimes(c.blobPath(checksum), now, now)
+	return release, nil
+}
+
+// verifyBlob checks a cached blob against its checksum, removing it if it does not match. A missing blob is not valid.
+func (c *cachingReleaseStore) verifyBlob(checksum string) (bool, error) {
+	file, err := os.Open(c.blobPath(checksum))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return false, err
+	}
+	if fmt.Sprintf("%x", hasher.Sum(nil)) == checksum {
+		return true, nil
+	}
+	if err := os.Remove(c.blobPath(checksum)); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return false, nil
+}
+
+func (c *cachingReleaseStore) openBlob(checksum string) (io.ReadCloser, error) {
+	file, err := os.Open(c.blobPath(checksum))
+	if err != nil {
+		return nil, err
+	}
+	return &digestVerifyingReader{body: file, hash: sha256.New(), expected: "sha256:" + checksum}, nil
+}
+
+// fetch downloads a release from the store into the cache, returning its checksum.
+func (c *cachingReleaseStore) fetch(component, version string) (string, error) {
+	release, err := c.ReleaseStore.Get(component, version)
+	if err != nil {
+		return "", err
+	}
+	defer release.Close()
+
+	blobsDir := filepath.Join(c.dir, "blobs")
+	if err := os.MkdirAll(blobsDir, 0755); err != nil {
+		return "", err
+	}
+	file, err := ioutil.TempFile(blobsDir, ".download-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hasher), release); err != nil {
+		file.Close()
+		return "", fmt.Errorf("error downloading release to cache: %s", err)
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	checksum := fmt.Sprintf("%x", hasher.Sum(nil))
+	if err := os.Rename(file.Name(), c.blobPath(checksum)); err != nil {
+		return "", err
+	}
+
+	indexPath := c.indexPath(component, version)
+	if err := os.MkdirAll(filepath.Dir(indexPath), 0755); err != nil {
+		return "", err
+	}
+	return checksum, writeFileAtomic(indexPath, []byte(checksum+"\n"))
+}
+
+// evict removes the least recently used blobs until the cache fits in its maximum size, always keeping the blob
+// that was just added. Index entries for evicted blobs are left behind and treated as misses.
+func (c *cachingReleaseStore) evict(keep string) error {
+	if c.maxSize <= 0 {
+		return nil
+	}
+	files, err := ioutil.ReadDir(filepath.Join(c.dir, "blobs"))
+	if err != nil {
+		return err
+	}
+	var total int64
+	var blobs []os.FileInfo
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		total += file.Size()
+		blobs = append(blobs, file)
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].ModTime().Before(blobs[j].ModTime())
+	})
+	for _, blob := range blobs {
+		if total <= c.maxSize {
+			break
+		}
+		if blob.Name() == keep {
+			continue
+		}
+		if err := os.Remove(c.blobPath(blob.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= blob.Size()
+	}
+	return nil
+}
+
+func (c *cachingReleaseStore) invalidate(component, version string) error {
+	if err := os.Remove(c.indexPath(component, version)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (c *cachingReleaseStore) Put(component, version string, release io.Reader) error {
+	if err := ValidateReleaseKey(component, version); err != nil {
+		return err
+	}
+	unlock := c.lock(component, version)
+	defer unlock()
+	if err := c.invalidate(component, version); err != nil {
+		return err
+	}
+	return c.ReleaseStore.Put(component, version, release)
+}
+
+func (c *cachingReleaseStore) Delete(component, version string) error {
+	if err := ValidateReleaseKey(component, version); err != nil {
+		return err
+	}
+	unlock := c.lock(component, version)
+	defer unlock()
+	if err := c.invalidate(component, version); err != nil {
+		return err
+	}
+	return c.ReleaseStore.Delete(component, version)
+}
@@ -0,0 +1,248 @@
+package common_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+// countingStore counts the number of times each release is got from the underlying store.
+type countingStore struct {
+	common.ReleaseStore
+	mutex sync.Mutex
+	gets  map[string]int
+}
+
+func (s *countingStore) Get(component, version string) (io.ReadCloser, error) {
+	s.mutex.Lock()
+	s.gets[component+"/"+version]++
+	s.mutex.Unlock()
+	return s.ReleaseStore.Get(component, version)
+}
+
+func createCachingStore(t *testing.T, maxSize int64) (*countingStore, common.ReleaseStore, func()) {
+	t.Helper()
+	storeDir, err := ioutil.TempDir("", "cdflow2-config-common-test-cache-store")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	cacheDir, err := ioutil.TempDir("", "cdflow2-config-common-test-cache")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	store := &countingStore{ReleaseStore: common.CreateFileReleaseStore(storeDir), gets: make(map[string]int)}
+	return store, common.CreateCachingReleaseStore(store, cacheDir, maxSize), func() {
+		os.RemoveAll(storeDir)
+		os.RemoveAll(cacheDir)
+	}
+}
+
+func readRelease(t *testing.T, store common.ReleaseStore, component, version string) []byte {
+	t.Helper()
+	reader, err := store.Get(component, version)
+	if err != nil {
+		t.Fatal("error getting release:", err)
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal("error reading release:", err)
+	}
+	return data
+}
+
+func TestCachingReleaseStoreConcurrentLoads(t *testing.T) {
+	// Given
+	store, cache, cleanup := createCachingStore(t, 0)
+	defer cleanup()
+	release := bytes.Repeat([]byte("release"), 1000)
+	if err := cache.Put("test-component", "1", bytes.NewReader(release)); err != nil {
+		t.Fatal("error putting release:", err)
+	}
+
+	// When
+	var wg sync.WaitGroup
+	results := make([][]byte, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reader, err := cache.Get("test-component", "1")
+			if err != nil {
+				t.Error("error getting release:", err)
+				return
+			}
+			defer reader.Close()
+			results[i], _ = ioutil.ReadAll(reader)
+		}(i)
+	}
+	wg.Wait()
+
+	// Then
+	if store.gets["test-component/1"] != 1 {
+		t.Fatalf("expected one download, got %d", store.gets["test-component/1"])
+	}
+	for _, result := range results {
+		if !bytes.Equal(result, release) {
+			t.Fatal("cached release does not match")
+		}
+	}
+}
+
+func TestCachingReleaseStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	// Given
+	store, cache, cleanup := createCachingStore(t, 250)
+	defer cleanup()
+	for _, version := range []string{"1", "2", "3"} {
+		if err := cache.Put("test-component", version, bytes.NewReader(bytes.Repeat([]byte(version), 100))); err != nil {
+			t.Fatal("error putting release:", err)
+		}
+	}
+
+	// When
+	readRelease(t, cache, "test-component", "1")
+	readRelease(t, cache, "test-component", "2")
+	readRelease(t, cache, "test-component", "3") // evicts 1, the least recently used
+	readRelease(t, cache, "test-component", "3")
+	readRelease(t, cache, "test-component", "1")
+
+	// Then
+	if store.gets["test-component/3"] != 1 {
+		t.Fatalf("expected version 3 to be cached, got %d downloads", store.gets["test-component/3"])
+	}
+	if store.gets["test-component/1"] != 2 {
+		t.Fatalf("expected version 1 to have been evicted, got %d downloads", store.gets["test-component/1"])
+	}
+}
+
+func TestCachingReleaseStoreInvalidatesOnPut(t *testing.T) {
+	// Given
+	_, cache, cleanup := createCachingStore(t, 0)
+	defer cleanup()
+	if err := cache.Put("test-component", "1", bytes.NewReader([]byte("first"))); err != nil {
+		t.Fatal("error putting release:", err)
+	}
+	readRelease(t, cache, "test-component", "1")
+
+	// When
+	if err := cache.Put("test-component", "1", bytes.NewReader([]byte("second"))); err != nil {
+		t.Fatal("error putting release:", err)
+	}
+
+	// Then
+	if got := readRelease(t, cache, "test-component", "1"); string(got) != "second" {
+		t.Fatalf("got %q, wanted %q", got, "second")
+	}
+}
+
+// closeHookStore calls a function when a release got from the underlying store is closed.
+type closeHookStore struct {
+	common.ReleaseStore
+	onClose func(version string)
+}
+
+type closeHookReader struct {
+	io.ReadCloser
+	onClose func()
+}
+
+func (r *closeHookReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.onClose()
+	return err
+}
+
+func (s *closeHookStore) Get(component, version string) (io.ReadCloser, error) {
+	reader, err := s.ReleaseStore.Get(component, version)
+	if err != nil {
+		return nil, err
+	}
+	return &closeHookReader{ReadCloser: reader, onClose: func() { s.onClose(version) }}, nil
+}
+
+func TestCachingReleaseStoreConcurrentEviction(t *testing.T) {
+	// Given
+	store, _, cleanup := createCachingStore(t, 0)
+	defer cleanup()
+	cacheDir, err := ioutil.TempDir("", "cdflow2-config-common-test-cache-eviction")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	defer os.RemoveAll(cacheDir)
+	releases := map[string][]byte{"1": bytes.Repeat([]byte("1"), 1000), "2": bytes.Repeat([]byte("2"), 1000)}
+	for version, release := range releases {
+		if err := store.Put("test-component", version, bytes.NewReader(release)); err != nil {
+			t.Fatal("error putting release:", err)
+		}
+	}
+	// the cache only has room for one release, and loading version 2 happens just after version 1 is downloaded
+	hooked := &closeHookStore{ReleaseStore: store}
+	cache := common.CreateCachingReleaseStore(hooked, cacheDir, 1500)
+	var once sync.Once
+	hooked.onClose = func(version string) {
+		if version == "1" {
+			once.Do(func() {
+				if data := readRelease(t, cache, "test-component", "2"); !bytes.Equal(data, releases["2"]) {
+					t.Error("unexpected content for version 2")
+				}
+			})
+		}
+	}
+
+	// When
+	data := readRelease(t, cache, "test-component", "1")
+
+	// Then
+	if !bytes.Equal(data, releases["1"]) {
+		t.Fatal("unexpected content for version 1")
+	}
+}
+
+func TestCachingReleaseStoreRefetchesCorruptBlob(t *testing.T) {
+	for _, format := range []common.ReleaseFormat{common.TarGzipFormat, common.TarZstdFormat} {
+		t.Run(format.Extension(), func(t *testing.T) {
+			// Given
+			storeDir, err := ioutil.TempDir("", "cdflow2-config-common-test-cache-store")
+			if err != nil {
+				t.Fatal("error creating temporary directory:", err)
+			}
+			defer os.RemoveAll(storeDir)
+			cacheDir, err := ioutil.TempDir("", "cdflow2-config-common-test-cache")
+			if err != nil {
+				t.Fatal("error creating temporary directory:", err)
+			}
+			defer os.RemoveAll(cacheDir)
+			store := &countingStore{ReleaseStore: common.CreateFileReleaseStore(storeDir), gets: make(map[string]int)}
+			cache := common.CreateCachingReleaseStore(store, cacheDir, 0)
+			release := savedRelease(t, format)
+			if err := store.Put("test-component", "1", bytes.NewReader(release)); err != nil {
+				t.Fatal("error putting release:", err)
+			}
+			readRelease(t, cache, "test-component", "1")
+			// past the end of the tar archive, so only the checksum can catch it
+			blob := filepath.Join(cacheDir, "blobs", fmt.Sprintf("%x", sha256.Sum256(release)))
+			if err := ioutil.WriteFile(blob, append(release, "corrupt"...), 0644); err != nil {
+				t.Fatal("error corrupting cached release:", err)
+			}
+
+			// When
+			err = loadRelease(t, cache, "test-component", "1")
+
+			// Then
+			if err != nil {
+				t.Fatal("error loading release:", err)
+			}
+			if store.gets["test-component/1"] != 2 {
+				t.Fatalf("expected corrupt release to be downloaded again, got %d downloads", store.gets["test-component/1"])
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// UploadStateDirName is the directory in the release dir where resumable uploads keep their state. It is never
+// included in the release.
+const UploadStateDirName = ".cdflow2-upload"
+
+// DefaultChunkSize is the chunk size used by the ReleaseStoreHandler for chunked uploads.
+const DefaultChunkSize = 16 * 1024 * 1024
+
+const (
+	uploadStateFilename   = "state.json"
+	uploadArchiveFilename = "release"
+)
+
+// uploadState is the resume token for a chunked upload.
+type uploadState struct {
+	Component       string
+	Version         string
+	UploadID        string
+	ChunkSize       int64
+	ArchiveSize     int64
+	ArchiveChecksum string
+	// ReleaseFingerprint identifies the release info and release dir contents the archive was saved from.
+	ReleaseFingerprint string
+	Chunks             []*UploadedChunk
+}
+
+// UploadReleaseResumable saves the release and uploads it to the store in chunks. The saved archive and a resume
+// token recording each chunk the store has accepted are kept in the release dir, so that if the upload is interrupted
+// a retried upload_release continues where it stopped rather than starting again. If the store has dropped the
+// upload in the meantime (e.g. it expired), a new upload is started from the saved archive. If the release info or the
+// contents of the release dir have changed since, the saved archive is discarded and the release saved again.
+func UploadReleaseResumable(
+	store ChunkedReleaseStore, saver ReleaseSaver, releaseInfo *ReleaseInfo, releaseDir string, chunkSize int64,
+) error {
+	stateDir := filepath.Join(releaseDir, UploadStateDirName)
+	fingerprint, err := releaseFingerprint(releaseInfo, releaseDir)
+	if err != nil {
+		return err
+	}
+	state, err := resumeUpload(store, stateDir, releaseInfo, fingerprint, chunkSize)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		if state, err = beginUpload(store, saver, stateDir, releaseInfo, fingerprint, releaseDir, chunkSize); err != nil {
+			return err
+		}
+	}
+
+	err = uploadChunks(store, stateDir, state)
+	if err == ErrUploadNotFound {
+		if err := restartUpload(store, stateDir, state); err != nil {
+			return err
+		}
+		err = uploadChunks(store, stateDir, state)
+	}
+	if err == ErrUploadNotFound {
+		return fmt.Errorf("error uploading release: %s", err)
+	}
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(stateDir)
+}
+
+// uploadChunks puts the chunks the store has not yet accepted and completes the upload. It returns ErrUploadNotFound
+// unwrapped if the store no longer has the upload.
+func uploadChunks(store ChunkedReleaseStore, stateDir string, state *uploadState) error {
+	archive, err := os.Open(filepath.Join(stateDir, uploadArchiveFilename))
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	chunkSize := state.ChunkSize
+	chunkCount := int((state.ArchiveSize + chunkSize - 1) / chunkSize)
+	if chunkCount == 0 {
+		chunkCount = 1
+	}
+	uploaded := make(map[int]bool)
+	for _, chunk := range state.Chunks {
+		uploaded[chunk.Index] = true
+	}
+	buffer := make([]byte, chunkSize)
+	for index := 0; index < chunkCount; index++ {
+		if uploaded[index] {
+			continue
+		}
+		n, err := archive.ReadAt(buffer, int64(index)*chunkSize)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		checksum := sha256.Sum256(buffer[:n])
+		chunk, err := store.PutChunk(
+			state.Component, state.Version, state.UploadID, index, buffer[:n],
+			base64.StdEncoding.EncodeToString(checksum[:]),
+		)
+		if err == ErrUploadNotFound {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("error uploading chunk %d of %d (the upload will resume from here if retried): %s", index+1, chunkCount, err)
+		}
+		state.Chunks = append(state.Chunks, chunk)
+		if err := writeUploadState(stateDir, state); err != nil {
+			return err
+		}
+	}
+
+	sortUploadedChunks(state.Chunks)
+	err = store.CompleteUpload(state.Component, state.Version, state.UploadID, state.Chunks)
+	if err == ErrUploadNotFound {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("error completing upload: %s", err)
+	}
+	return nil
+}
+
+// restartUpload begins a new upload of the saved archive, for when the store has dropped the previous one.
+func restartUpload(store ChunkedReleaseStore, stateDir string, state *uploadState) error {
+	uploadID, err := store.BeginUpload(state.Component, state.Version)
+	if err != nil {
+		return fmt.Errorf("error beginning upload: %s", err)
+	}
+	state.UploadID = uploadID
+	state.Chunks = nil
+	return writeUploadState(stateDir, state)
+}
+
+// resumeUpload returns the state of a previous upload of the same release, or nil if there isn't a usable one. The
+// store's upload for state that is discarded is aborted, so it doesn't linger (and, for S3, keep being billed).
+func resumeUpload(
+	store ChunkedReleaseStore, stateDir string, releaseInfo *ReleaseInfo, fingerprint string, chunkSize int64,
+) (*uploadState, error) {
+	data, err := ioutil.ReadFile(filepath.Join(stateDir, uploadStateFilename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state uploadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, nil
+	}
+	if state.Component != releaseInfo.Component || state.Version != releaseInfo.Version || state.ChunkSize != chunkSize ||
+		state.ReleaseFingerprint != fingerprint || !uploadArchiveMatches(stateDir, &state) {
+		abortUpload(store, &state)
+		return nil, nil
+	}
+	return &state, nil
+}
+
+func uploadArchiveMatches(stateDir string, state *uploadState) bool {
+	archive, err := os.Open(filepath.Join(stateDir, uploadArchiveFilename))
+	if err != nil {
+		return false
+	}
+	defer archive.Close()
+	checksum, err := sha256File(archive)
+	return err == nil && checksum == state.ArchiveChecksum
+}
+
+// releaseFingerprint hashes the release info and the paths, modes and contents of everything in the release dir (apart
+// from the upload state), so a retried upload can tell whether the saved archive is still of the same release.
+func releaseFingerprint(releaseInfo *ReleaseInfo, releaseDir string) (string, error) {
+	hasher := sha256.New()
+	if err := json.NewEncoder(hasher).Encode(releaseInfo); err != nil {
+		return "", err
+	}
+	if err := filepath.Walk(releaseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(releaseDir, path)
+		if err != nil {
+			return err
+		}
+		if relativePath == UploadStateDirName {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		fmt.Fprintf(hasher, "%q %s %d\n", filepath.ToSlash(relativePath), info.Mode(), info.Size())
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(hasher, "%q\n", target)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(hasher, file)
+		return err
+	}); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// abortUpload aborts the store's upload for discarded state, logging rather than failing if it can't, since the
+// new upload doesn't depend on it.
+func abortUpload(store ChunkedReleaseStore, state *uploadState) {
+	if state.UploadID == "" {
+		return
+	}
+	if err := store.AbortUpload(state.Component, state.Version, state.UploadID); err != nil && err != ErrUploadNotFound {
+		log.Printf("error aborting previous upload %s of %s version %s: %s", state.UploadID, state.Component, state.Version, err)
+	}
+}
+
+func beginUpload(
+	store ChunkedReleaseStore, saver ReleaseSaver, stateDir string, releaseInfo *ReleaseInfo, fingerprint, releaseDir string,
+	chunkSize int64,
+) (*uploadState, error) {
+	if err := os.RemoveAll(stateDir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return nil, err
+	}
+	release, err := saveReleaseWithInfo(saver, releaseInfo, releaseDir)
+	if err != nil {
+		return nil, fmt.Errorf("error saving release: %s", err)
+	}
+	defer release.Close()
+	archive, err := os.Create(filepath.Join(stateDir, uploadArchiveFilename))
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(archive, hasher), release)
+	if err != nil {
+		return nil, err
+	}
+	if err := archive.Sync(); err != nil {
+		return nil, err
+	}
+	uploadID, err := store.BeginUpload(releaseInfo.Component, releaseInfo.Version)
+	if err != nil {
+		return nil, fmt.Errorf("error beginning upload: %s", err)
+	}
+	state := &uploadState{
+		Component:          releaseInfo.Component,
+		Version:            releaseInfo.Version,
+		UploadID:           uploadID,
+		ChunkSize:          chunkSize,
+		ArchiveSize:        size,
+		ArchiveChecksum:    fmt.Sprintf("%x", hasher.Sum(nil)),
+		ReleaseFingerprint: fingerprint,
+	}
+	return state, writeUploadState(stateDir, state)
+}
+
+// writeUploadState replaces the resume token atomically, so an interruption never leaves it half written.
+func writeUploadState(stateDir string, state *uploadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(stateDir, uploadStateFilename), data)
+}
+
+// writeFileAtomic writes to a temporary file in the same directory and renames it into place.
+func writeFileAtomic(filename string, data []byte) error {
+	file, err := ioutil.TempFile(filepath.Dir(filename), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filename)
+}
+
+func sortUploadedChunks(chunks []*UploadedChunk) {
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Index < chunks[j].Index
+	})
+}
@@ -0,0 +1,241 @@
+package common_test
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+// flakyChunkedStore fails the first attempt to put a given chunk, recording the chunks put and uploads aborted.
+type flakyChunkedStore struct {
+	common.ChunkedReleaseStore
+	failIndex int
+	failed    bool
+	puts      []int
+	aborted   []string
+}
+
+func (s *flakyChunkedStore) AbortUpload(component, version, uploadID string) error {
+	s.aborted = append(s.aborted, uploadID)
+	return s.ChunkedReleaseStore.AbortUpload(component, version, uploadID)
+}
+
+func (s *flakyChunkedStore) PutChunk(component, version, uploadID string, index int, chunk []byte, checksum string) (*common.UploadedChunk, error) {
+	if index == s.failIndex && !s.failed {
+		s.failed = true
+		return nil, errors.New("connection reset")
+	}
+	s.puts = append(s.puts, index)
+	return s.ChunkedReleaseStore.PutChunk(component, version, uploadID, index, chunk, checksum)
+}
+
+// createChunkedUploadTest returns a file store, a release dir with random content, and a cleanup function.
+func createChunkedUploadTest(t *testing.T) (common.ChunkedReleaseStore, string, []byte, func()) {
+	t.Helper()
+	storeDir, err := ioutil.TempDir("", "cdflow2-config-common-test-chunked-store")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	sourceDir, err := ioutil.TempDir("", "cdflow2-config-common-test-chunked-release")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	content := make([]byte, 10*1024)
+	rand.Read(content)
+	if err := ioutil.WriteFile(filepath.Join(sourceDir, "provider"), content, 0755); err != nil {
+		t.Fatal("error writing file:", err)
+	}
+	return common.CreateFileReleaseStore(storeDir).(common.ChunkedReleaseStore), sourceDir, content, func() {
+		os.RemoveAll(storeDir)
+		os.RemoveAll(sourceDir)
+	}
+}
+
+func checkUploadedRelease(t *testing.T, store common.ReleaseStore, content []byte) {
+	t.Helper()
+	destDir, err := ioutil.TempDir("", "cdflow2-config-common-test-chunked-dest")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	defer os.RemoveAll(destDir)
+	release, err := store.Get("test-component", "1")
+	if err != nil {
+		t.Fatal("error getting release:", err)
+	}
+	defer release.Close()
+	if _, err := common.UnzipRelease(release, destDir, "test-component", "1"); err != nil {
+		t.Fatal("error unzipping release:", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(destDir, "provider")); err != nil || string(data) != string(content) {
+		t.Fatal("release content does not match:", err)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, common.UploadStateDirName)); !os.IsNotExist(err) {
+		t.Fatal("upload state should not be included in the release")
+	}
+}
+
+// uploadID reads the upload ID from the resume token, as the store would have it.
+func uploadID(t *testing.T, releaseDir string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join(releaseDir, common.UploadStateDirName, "state.json"))
+	if err != nil {
+		t.Fatal("error reading upload state:", err)
+	}
+	var state struct{ UploadID string }
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal("error decoding upload state:", err)
+	}
+	return state.UploadID
+}
+
+func TestUploadReleaseResumable(t *testing.T) {
+	// Given
+	fileStore, sourceDir, content, cleanup := createChunkedUploadTest(t)
+	defer cleanup()
+	store := &flakyChunkedStore{ChunkedReleaseStore: fileStore, failIndex: 3}
+	releaseInfo := &common.ReleaseInfo{Component: "test-component", Version: "1", TerraformImage: "test-terraform-image"}
+	const chunkSize = 1024
+
+	// When
+	err := common.UploadReleaseResumable(store, common.CreateReleaseSaver(), releaseInfo, sourceDir, chunkSize)
+	if err == nil {
+		t.Fatal("expected first upload attempt to fail")
+	}
+	if _, statErr := os.Stat(filepath.Join(sourceDir, common.UploadStateDirName)); statErr != nil {
+		t.Fatal("expected upload state to be kept after failure:", statErr)
+	}
+	attempts := len(store.puts)
+	if err := common.UploadReleaseResumable(store, common.CreateReleaseSaver(), releaseInfo, sourceDir, chunkSize); err != nil {
+		t.Fatal("error resuming upload:", err)
+	}
+
+	// Then
+	if attempts != 3 {
+		t.Fatalf("expected 3 chunks before the failure, got %v", store.puts)
+	}
+	if store.puts[attempts] != 3 {
+		t.Fatalf("expected upload to resume from chunk 3, got %v", store.puts)
+	}
+	for i, index := range store.puts {
+		if i > 0 && index <= store.puts[i-1] {
+			t.Fatalf("chunk uploaded more than once: %v", store.puts)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(sourceDir, common.UploadStateDirName)); !os.IsNotExist(err) {
+		t.Fatal("expected upload state to be removed after completion")
+	}
+	checkUploadedRelease(t, fileStore, content)
+}
+
+func TestUploadReleaseResumableRestartsLostUpload(t *testing.T) {
+	// Given
+	fileStore, sourceDir, content, cleanup := createChunkedUploadTest(t)
+	defer cleanup()
+	store := &flakyChunkedStore{ChunkedReleaseStore: fileStore, failIndex: 3}
+	releaseInfo := &common.ReleaseInfo{Component: "test-component", Version: "1", TerraformImage: "test-terraform-image"}
+	if err := common.UploadReleaseResumable(store, common.CreateReleaseSaver(), releaseInfo, sourceDir, 1024); err == nil {
+		t.Fatal("expected first upload attempt to fail")
+	}
+	// the store drops the upload, as S3 does when a multipart upload expires
+	lostUploadID := uploadID(t, sourceDir)
+	if err := fileStore.AbortUpload("test-component", "1", lostUploadID); err != nil {
+		t.Fatal("error aborting upload:", err)
+	}
+
+	// When
+	if err := common.UploadReleaseResumable(store, common.CreateReleaseSaver(), releaseInfo, sourceDir, 1024); err != nil {
+		t.Fatal("error retrying upload:", err)
+	}
+
+	// Then
+	checkUploadedRelease(t, fileStore, content)
+}
+
+func TestUploadReleaseResumableAbortsDiscardedUpload(t *testing.T) {
+	// Given
+	fileStore, sourceDir, content, cleanup := createChunkedUploadTest(t)
+	defer cleanup()
+	store := &flakyChunkedStore{ChunkedReleaseStore: fileStore, failIndex: 3}
+	releaseInfo := &common.ReleaseInfo{Component: "test-component", Version: "1", TerraformImage: "test-terraform-image"}
+	if err := common.UploadReleaseResumable(store, common.CreateReleaseSaver(), releaseInfo, sourceDir, 1024); err == nil {
+		t.Fatal("expected first upload attempt to fail")
+	}
+	previousUploadID := uploadID(t, sourceDir)
+
+	// When - a different chunk size means the previous state can't be resumed
+	if err := common.UploadReleaseResumable(store, common.CreateReleaseSaver(), releaseInfo, sourceDir, 2048); err != nil {
+		t.Fatal("error uploading release:", err)
+	}
+
+	// Then
+	if len(store.aborted) != 1 || store.aborted[0] != previousUploadID {
+		t.Fatalf("expected upload %s to be aborted, got %v", previousUploadID, store.aborted)
+	}
+	checkUploadedRelease(t, fileStore, content)
+}
+
+func TestUploadReleaseResumableDiscardsUploadOfChangedRelease(t *testing.T) {
+	// Given
+	fileStore, sourceDir, content, cleanup := createChunkedUploadTest(t)
+	defer cleanup()
+	store := &flakyChunkedStore{ChunkedReleaseStore: fileStore, failIndex: 3}
+	releaseInfo := &common.ReleaseInfo{Component: "test-component", Version: "1", TerraformImage: "test-terraform-image"}
+	if err := common.UploadReleaseResumable(store, common.CreateReleaseSaver(), releaseInfo, sourceDir, 1024); err == nil {
+		t.Fatal("expected first upload attempt to fail")
+	}
+	previousUploadID := uploadID(t, sourceDir)
+
+	// When - the retry has a different terraform image
+	releaseInfo.TerraformImage = "other-terraform-image"
+	if err := common.UploadReleaseResumable(store, common.CreateReleaseSaver(), releaseInfo, sourceDir, 1024); err != nil {
+		t.Fatal("error uploading release:", err)
+	}
+
+	// Then
+	if len(store.aborted) != 1 || store.aborted[0] != previousUploadID {
+		t.Fatalf("expected upload %s to be aborted, got %v", previousUploadID, store.aborted)
+	}
+	checkUploadedRelease(t, fileStore, content)
+	release, err := fileStore.Get("test-component", "1")
+	if err != nil {
+		t.Fatal("error getting release:", err)
+	}
+	defer release.Close()
+	uploaded, err := common.ReadReleaseInfo(release)
+	if err != nil {
+		t.Fatal("error reading release info:", err)
+	}
+	if uploaded.TerraformImage != "other-terraform-image" {
+		t.Fatalf("got terraform image %q, wanted %q", uploaded.TerraformImage, "other-terraform-image")
+	}
+}
+
+func TestUploadReleaseResumableDiscardsUploadOfChangedReleaseDir(t *testing.T) {
+	// Given
+	fileStore, sourceDir, _, cleanup := createChunkedUploadTest(t)
+	defer cleanup()
+	store := &flakyChunkedStore{ChunkedReleaseStore: fileStore, failIndex: 3}
+	releaseInfo := &common.ReleaseInfo{Component: "test-component", Version: "1", TerraformImage: "test-terraform-image"}
+	if err := common.UploadReleaseResumable(store, common.CreateReleaseSaver(), releaseInfo, sourceDir, 1024); err == nil {
+		t.Fatal("expected first upload attempt to fail")
+	}
+
+	// When - the release dir is rebuilt before the retry
+	content := make([]byte, 10*1024)
+	rand.Read(content)
+	if err := ioutil.WriteFile(filepath.Join(sourceDir, "provider"), content, 0755); err != nil {
+		t.Fatal("error writing file:", err)
+	}
+	if err := common.UploadReleaseResumable(store, common.CreateReleaseSaver(), releaseInfo, sourceDir, 1024); err != nil {
+		t.Fatal("error uploading release:", err)
+	}
+
+	// Then
+	checkUploadedRelease(t, fileStore, content)
+}
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -78,6 +79,55 @@ func CreatePrepareTerraformResponse() *PrepareTerraformResponse {
 	return &response
 }
 
+// CreateReleaseInfo returns the release info for an upload release request, combined with the configure release
+// request and response that preceded it (the response may be nil if it was not kept). It returns an error if there was
+// no configure release request.
+func CreateReleaseInfo(
+	request *UploadReleaseRequest,
+	configureReleaseRequest *ConfigureReleaseRequest,
+	configureReleaseResponse *ConfigureReleaseResponse,
+) (*ReleaseInfo, error) {
+	if configureReleaseRequest == nil {
+		return nil, errors.New("no configure release request before upload release")
+	}
+	releaseInfo := &ReleaseInfo{
+		Component:       configureReleaseRequest.Component,
+		Version:         configureReleaseRequest.Version,
+		Team:            configureReleaseRequest.Team,
+		Commit:          configureReleaseRequest.Commit,
+		TerraformImage:  request.TerraformImage,
+		ReleaseMetadata: request.ReleaseMetadata,
+	}
+	if configureReleaseResponse != nil {
+		releaseInfo.AdditionalMetadata = configureReleaseResponse.AdditionalMetadata
+	}
+	return releaseInfo, nil
+}
+
+// loadReleaseWithInfo calls LoadWithInfo if the loader implements ReleaseInfoLoader, or Load if not, in which case only
+// the component, version and terraform image of the release info are set.
+func loadReleaseWithInfo(
+	loader ReleaseLoader, reader io.Reader, component, version, releaseDir string,
+) (*ReleaseInfo, error) {
+	if infoLoader, ok := loader.(ReleaseInfoLoader); ok {
+		return infoLoader.LoadWithInfo(reader, component, version, releaseDir)
+	}
+	terraformImage, err := loader.Load(reader, component, version, releaseDir)
+	if err != nil {
+		return nil, err
+	}
+	return &ReleaseInfo{Component: component, Version: version, TerraformImage: terraformImage}, nil
+}
+
+// saveReleaseWithInfo calls SaveWithInfo if the saver implements ReleaseInfoSaver, or Save if not, in which case only
+// the component, version and terraform image of the release info are stored.
+func saveReleaseWithInfo(saver ReleaseSaver, releaseInfo *ReleaseInfo, releaseDir string) (io.ReadCloser, error) {
+	if infoSaver, ok := saver.(ReleaseInfoSaver); ok {
+		return infoSaver.SaveWithInfo(releaseInfo, releaseDir)
+	}
+	return saver.Save(releaseInfo.Component, releaseInfo.Version, releaseInfo.TerraformImage, releaseDir)
+}
+
 type releaseLoader struct{}
 
 // CreateReleaseLoader returns a ReleaseLoader.
@@ -86,34 +136,63 @@ func CreateReleaseLoader() ReleaseLoader {
 }
 
 // Load unpacks a release into a release directory.
-func (*releaseLoader) Load(
+func (l *releaseLoader) Load(
 	reader io.Reader, component, version, releaseDir string,
 ) (string, error) {
-	terraformImage, err := UnzipRelease(reader, releaseDir, component, version)
+	releaseInfo, err := l.LoadWithInfo(reader, component, version, releaseDir)
+	if err != nil {
+		return "", err
+	}
+	return releaseInfo.TerraformImage, nil
+}
+
+// LoadWithInfo unpacks a release into a release directory, returning the release info stored in it.
+func (*releaseLoader) LoadWithInfo(
+	reader io.Reader, component, version, releaseDir string,
+) (*ReleaseInfo, error) {
+	releaseInfo, err := UnpackRelease(reader, releaseDir, component, version)
 	if err != nil {
-		return "", fmt.Errorf("error unzipping release in PrepareTerraform: %s", err)
+		return nil, fmt.Errorf("error unzipping release in PrepareTerraform: %s", err)
 	}
-	return terraformImage, nil
+	return releaseInfo, nil
 }
 
-type releaseSaver struct{}
+type releaseSaver struct {
+	format ReleaseFormat
+}
 
-// CreateReleaseSaver returns a ReleaseSaver.
+// CreateReleaseSaver returns a ReleaseSaver that saves releases as zip files.
 func CreateReleaseSaver() ReleaseSaver {
-	return &releaseSaver{}
+	return CreateReleaseSaverWithFormat(ZipFormat)
+}
+
+// CreateReleaseSaverWithFormat returns a ReleaseSaver that saves releases in the given format.
+func CreateReleaseSaverWithFormat(format ReleaseFormat) ReleaseSaver {
+	return &releaseSaver{format: format}
 }
 
-// Save returns a reader for the release zip.
-func (*releaseSaver) Save(
+// Save returns a reader for the release archive.
+func (s *releaseSaver) Save(
 	component, version, terraformImage, releaseDir string,
+) (io.ReadCloser, error) {
+	return s.SaveWithInfo(&ReleaseInfo{
+		Component:      component,
+		Version:        version,
+		TerraformImage: terraformImage,
+	}, releaseDir)
+}
+
+// SaveWithInfo returns a reader for the release archive, including the release info.
+func (s *releaseSaver) SaveWithInfo(
+	releaseInfo *ReleaseInfo, releaseDir string,
 ) (io.ReadCloser, error) {
 	file, err := ioutil.TempFile("", "cdflow2-config-common-release")
 	if err != nil {
 		return nil, err
 	}
 	defer os.Remove(file.Name())
-	if err := ZipRelease(
-		file, releaseDir, component, version, terraformImage,
+	if err := ArchiveRelease(
+		file, s.format, releaseDir, releaseInfo,
 	); err != nil {
 		return nil, err
 	}
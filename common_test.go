@@ -7,7 +7,9 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"strings"
 	"testing"
 
 	common "github.com/mergermarket/cdflow2-config-common"
@@ -134,15 +136,18 @@ func TestZipRelease(t *testing.T) {
 	if err != nil {
 		t.Fatal("could not create zip reader:", err)
 	}
-	if len(zipReader.File) != 2 {
-		t.Fatalf("expected %v, got %v", 2, len(zipReader.File))
+	if len(zipReader.File) != 3 {
+		t.Fatalf("expected %v, got %v", 3, len(zipReader.File))
 	}
 	if zipReader.File[0].Name != "test-component-test-version/terraform-image" {
 		t.Fatal("unexpected filename in zip:", zipReader.File[0].Name)
 	}
-	if zipReader.File[1].Name != "test-component-test-version/test.txt" {
+	if zipReader.File[1].Name != "test-component-test-version/release.json" {
 		t.Fatal("unexpected filename in zip:", zipReader.File[1].Name)
 	}
+	if zipReader.File[2].Name != "test-component-test-version/test.txt" {
+		t.Fatal("unexpected filename in zip:", zipReader.File[2].Name)
+	}
 }
 
 func TestUnzipRelease(t *testing.T) {
@@ -181,3 +186,292 @@ func TestUnzipRelease(t *testing.T) {
 		t.Fatalf("problem reading file, data: %v, error: %v\n", data, err)
 	}
 }
+
+func TestReleaseRoundTripPreservesSymlinksAndEmptyDirs(t *testing.T) {
+	// Given
+	sourceDir, err := ioutil.TempDir("", "cdflow2-config-common-test-symlinks-source")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	defer os.RemoveAll(sourceDir)
+	if err := os.MkdirAll(filepath.Join(sourceDir, "modules", "shared"), 0755); err != nil {
+		t.Fatal("error creating module dir:", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(sourceDir, "modules", "shared", "main.tf"), []byte("shared"), 0644); err != nil {
+		t.Fatal("error writing file:", err)
+	}
+	if err := os.Symlink("modules/shared", filepath.Join(sourceDir, "shared")); err != nil {
+		t.Fatal("error creating symlink:", err)
+	}
+	if err := os.MkdirAll(filepath.Join(sourceDir, "placeholder"), 0755); err != nil {
+		t.Fatal("error creating empty dir:", err)
+	}
+
+	var buffer bytes.Buffer
+	if err := common.ZipRelease(
+		&buffer, sourceDir, "test-component", "test-version", "test-terraform-image",
+	); err != nil {
+		t.Fatal("error zipping release:", err)
+	}
+
+	destDir, err := ioutil.TempDir("", "cdflow2-config-common-test-symlinks-dest")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	defer os.RemoveAll(destDir)
+
+	// When
+	if _, err := common.UnzipRelease(
+		bytes.NewReader(buffer.Bytes()), destDir, "test-component", "test-version",
+	); err != nil {
+		t.Fatal("unexpected error unzipping release:", err)
+	}
+
+	// Then
+	target, err := os.Readlink(filepath.Join(destDir, "shared"))
+	if err != nil {
+		t.Fatal("expected symlink:", err)
+	}
+	if target != "modules/shared" {
+		t.Fatalf("got %q, wanted %q", target, "modules/shared")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(destDir, "shared", "main.tf")); err != nil || string(data) != "shared" {
+		t.Fatalf("problem reading through symlink, data: %v, error: %v\n", data, err)
+	}
+	if info, err := os.Stat(filepath.Join(destDir, "placeholder")); err != nil || !info.IsDir() {
+		t.Fatalf("expected empty directory to be recreated, info: %v, error: %v", info, err)
+	}
+}
+
+func TestZipReleaseRejectsSymlinkOutsideRelease(t *testing.T) {
+	for name, symlinks := range map[string][][2]string{
+		"symlink escape": {{"passwd", "../../etc/passwd"}},
+		"symlink chain":  {{"a", "."}, {"s2", "a"}, {"s1", "s2/.."}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Given
+			sourceDir, err := ioutil.TempDir("", "cdflow2-config-common-test-symlinks-escape")
+			if err != nil {
+				t.Fatal("error creating temporary directory:", err)
+			}
+			defer os.RemoveAll(sourceDir)
+			for _, symlink := range symlinks {
+				if err := os.Symlink(symlink[1], filepath.Join(sourceDir, symlink[0])); err != nil {
+					t.Fatal("error creating symlink:", err)
+				}
+			}
+
+			// When
+			err = common.ZipRelease(
+				ioutil.Discard, sourceDir, "test-component", "test-version", "test-terraform-image",
+			)
+
+			// Then
+			if err == nil {
+				t.Fatal("expected error for symlink outside of release")
+			}
+		})
+	}
+}
+
+// maliciousRelease builds a zip release with the given entries, where entries with a symlink target are symlinks.
+func maliciousRelease(t *testing.T, entries [][2]string) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	zipWriter := zip.NewWriter(&buffer)
+	entries = append([][2]string{{"terraform-image", ""}}, entries...)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: "test-component-test-version/" + entry[0]}
+		content := "test-terraform-image"
+		if entry[0] != "terraform-image" {
+			header.SetMode(0644)
+			content = "escaped"
+		}
+		if entry[1] != "" {
+			header.SetMode(os.ModeSymlink | 0777)
+			content = entry[1]
+		}
+		writer, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			t.Fatal("error creating zip entry:", err)
+		}
+		if _, err := writer.Write([]byte(content)); err != nil {
+			t.Fatal("error writing zip entry:", err)
+		}
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatal("error closing zip:", err)
+	}
+	return buffer.Bytes()
+}
+
+func TestUnzipReleaseRejectsEntriesOutsideRelease(t *testing.T) {
+	for name, entries := range map[string][][2]string{
+		"dot-dot":          {{"../escaped.txt", ""}},
+		"nested dot-dot":   {{"dir/../../escaped.txt", ""}},
+		"symlink escape":   {{"passwd", "../../etc/passwd"}},
+		"absolute symlink": {{"passwd", "/etc/passwd"}},
+		"chained symlinks": {{"d1/l", ".."}, {"d1/l/l2", ".."}, {"d1/l/l2/escaped.txt", ""}},
+		"through symlink":  {{"d1/l", "."}, {"d1/l/escaped.txt", ""}},
+		"symlink chain":    {{"s1", "s2/.."}, {"a", "."}, {"s2", "a"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Given
+			parent, err := ioutil.TempDir("", "cdflow2-config-common-test-unzip-malicious")
+			if err != nil {
+				t.Fatal("error creating temporary directory:", err)
+			}
+			defer os.RemoveAll(parent)
+			dir := filepath.Join(parent, "release")
+
+			// When
+			_, err = common.UnzipRelease(
+				bytes.NewReader(maliciousRelease(t, entries)), dir, "test-component", "test-version",
+			)
+
+			// Then
+			if err == nil {
+				t.Fatal("expected error for entry outside of release")
+			}
+			for _, escaped := range []string{filepath.Join(parent, "escaped.txt"), filepath.Join(filepath.Dir(parent), "escaped.txt")} {
+				if _, err := os.Lstat(escaped); err == nil {
+					os.Remove(escaped)
+					t.Fatalf("release wrote %s outside of the release dir", escaped)
+				}
+			}
+			filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.Mode()&os.ModeSymlink == 0 {
+					return nil
+				}
+				if resolved, err := filepath.EvalSymlinks(path); err == nil && !strings.HasPrefix(resolved, dir) {
+					t.Errorf("release left symlink %s to %s, outside of the release dir", path, resolved)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestReleaseFormatsRoundTrip(t *testing.T) {
+	for _, format := range []common.ReleaseFormat{common.ZipFormat, common.TarGzipFormat, common.TarZstdFormat} {
+		t.Run(format.Extension(), func(t *testing.T) {
+			// Given
+			dir, err := ioutil.TempDir("", "cdflow2-config-common-test-release-format")
+			if err != nil {
+				t.Fatal("error creating temporary directory:", err)
+			}
+			defer os.RemoveAll(dir)
+
+			var buffer bytes.Buffer
+			if err := common.ArchiveRelease(
+				&buffer, format, releaseDir(t), &common.ReleaseInfo{
+					Component:      "test-component",
+					Version:        "test-version",
+					TerraformImage: "test-terraform-image",
+				},
+			); err != nil {
+				t.Fatal("error archiving release:", err)
+			}
+
+			// When
+			detected, reader, err := common.DetectReleaseFormat(bytes.NewReader(buffer.Bytes()))
+			if err != nil {
+				t.Fatal("error detecting release format:", err)
+			}
+			terraformImage, err := common.UnzipRelease(reader, dir, "test-component", "test-version")
+			if err != nil {
+				t.Fatal("unexpected error unpacking release:", err)
+			}
+
+			// Then
+			if detected != format {
+				t.Fatalf("detected %q, wanted %q", detected.Extension(), format.Extension())
+			}
+			if terraformImage != "test-terraform-image" {
+				t.Fatalf("got %q, wanted %q", terraformImage, "test-terraform-image")
+			}
+			if data, err := ioutil.ReadFile(filepath.Join(dir, "test.txt")); err != nil || string(data) != "test" {
+				t.Fatalf("problem reading file, data: %v, error: %v\n", data, err)
+			}
+		})
+	}
+}
+
+func TestDetectReleaseFormatRejectsUnknownFormat(t *testing.T) {
+	if _, _, err := common.DetectReleaseFormat(bytes.NewReader([]byte("not a release"))); err == nil {
+		t.Fatal("expected error for unknown release format")
+	}
+}
+
+func TestReadReleaseInfo(t *testing.T) {
+	for _, format := range []common.ReleaseFormat{common.ZipFormat, common.TarZstdFormat} {
+		t.Run(format.Extension(), func(t *testing.T) {
+			// Given
+			uploadReleaseRequest := common.CreateUploadReleaseRequest()
+			uploadReleaseRequest.TerraformImage = "test-terraform-image"
+			uploadReleaseRequest.ReleaseMetadata["release"] = map[string]string{"release-key": "release-value"}
+			configureReleaseRequest := common.CreateConfigureReleaseRequest()
+			configureReleaseRequest.Component = "test-component"
+			configureReleaseRequest.Version = "test-version"
+			configureReleaseRequest.Team = "test-team"
+			configureReleaseRequest.Commit = "test-commit"
+			configureReleaseResponse := common.CreateConfigureReleaseResponse()
+			configureReleaseResponse.AdditionalMetadata["foo"] = "bar"
+			releaseInfo, err := common.CreateReleaseInfo(uploadReleaseRequest, configureReleaseRequest, configureReleaseResponse)
+			if err != nil {
+				t.Fatal("error creating release info:", err)
+			}
+
+			var buffer bytes.Buffer
+			if err := common.ArchiveRelease(&buffer, format, releaseDir(t), releaseInfo); err != nil {
+				t.Fatal("error archiving release:", err)
+			}
+
+			// When
+			got, err := common.ReadReleaseInfo(bytes.NewReader(buffer.Bytes()))
+			if err != nil {
+				t.Fatal("error reading release info:", err)
+			}
+
+			// Then
+			if !reflect.DeepEqual(got, releaseInfo) {
+				t.Fatalf("got %+v, wanted %+v", got, releaseInfo)
+			}
+		})
+	}
+}
+
+func TestLoadWithInfo(t *testing.T) {
+	// Given
+	dir, err := ioutil.TempDir("", "cdflow2-config-common-test-load-with-info")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	defer os.RemoveAll(dir)
+	releaseInfo := &common.ReleaseInfo{
+		Component:      "test-component",
+		Version:        "test-version",
+		Team:           "test-team",
+		Commit:         "test-commit",
+		TerraformImage: "test-terraform-image",
+	}
+	release, err := common.CreateReleaseSaver().(common.ReleaseInfoSaver).SaveWithInfo(releaseInfo, releaseDir(t))
+	if err != nil {
+		t.Fatal("error saving release:", err)
+	}
+	defer release.Close()
+
+	// When
+	got, err := common.CreateReleaseLoader().(common.ReleaseInfoLoader).LoadWithInfo(release, "test-component", "test-version", dir)
+	if err != nil {
+		t.Fatal("error loading release:", err)
+	}
+
+	// Then
+	if !reflect.DeepEqual(got, releaseInfo) {
+		t.Fatalf("got %+v, wanted %+v", got, releaseInfo)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "release.json")); !os.IsNotExist(err) {
+		t.Fatal("release.json should not be extracted into the release dir")
+	}
+}
@@ -0,0 +1,367 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigError is a problem with one key of a request's Config. Key is the path to the value in cdflow.yaml, e.g.
+// config.buckets[0].name.
+type ConfigError struct {
+	Key     string
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	return e.Key + ": " + e.Message
+}
+
+// ConfigErrors is every problem found decoding a request's Config.
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	lines := make([]string, 0, len(e)+1)
+	lines = append(lines, "invalid config:")
+	for _, err := range e {
+		lines = append(lines, "  "+err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// DecodeConfig decodes a request's Config into the struct pointed to by target. Fields are matched to keys by the
+// config tag, or by name (ignoring case) if there is none, and the following tags control decoding and validation:
+//
+//	config:"name"        the key for the field, or "-" to ignore it
+//	default:"value"      the value to use when the key is not set
+//	required:"true"      the key must be set
+//	enum:"a,b,c"         the value must be one of these
+//	pattern:"^[a-z]+$"   a string must match the regular expression
+//	min:"1" max:"10"     the range of a number, or the length of a string, list or map
+//
+// Nested structs, pointers, lists, maps and time.Duration (from strings such as "5m") are supported. All problems
+// found are returned together as ConfigErrors.
+func DecodeConfig(config map[string]interface{}, target interface{}) error {
+	value := reflect.ValueOf(target)
+	if value.Kind() != reflect.Ptr || value.IsNil() || value.Elem().Kind() != reflect.Struct {
+		return errors.New("DecodeConfig target must be a pointer to a struct")
+	}
+	decoder := &configDecoder{}
+	decoder.decodeStruct("config", config, value.Elem())
+	if len(decoder.errors) > 0 {
+		return decoder.errors
+	}
+	return nil
+}
+
+type configDecoder struct {
+	errors ConfigErrors
+}
+
+func (d *configDecoder) fail(key, format string, args ...interface{}) {
+	d.errors = append(d.errors, &ConfigError{Key: key, Message: fmt.Sprintf(format, args...)})
+}
+
+func (d *configDecoder) decodeStruct(path string, values map[string]interface{}, target reflect.Value) {
+	targetType := target.Type()
+	for i := 0; i < targetType.NumField(); i++ {
+		field := targetType.Field(i)
+		name := field.Tag.Get("config")
+		if name == "-" || field.PkgPath != "" {
+			continue
+		}
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			d.decodeStruct(path, values, target.Field(i))
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		key, value, ok := lookupConfigKey(values, name)
+		fieldPath := path + "." + key
+		if !ok || value == nil {
+			defaultValue, hasDefault := field.Tag.Lookup("default")
+			if !hasDefault {
+				if field.Tag.Get("required") == "true" {
+					d.fail(fieldPath, "is required")
+				} else if field.Type.Kind() == reflect.Struct {
+					// apply the defaults and required checks of the nested struct
+					d.decodeStruct(fieldPath, map[string]interface{}{}, target.Field(i))
+				}
+				continue
+			}
+			parsed, err := parseConfigDefault(defaultValue, field.Type)
+			if err != nil {
+				d.fail(fieldPath, "invalid default %q: %s", defaultValue, err)
+				continue
+			}
+			value = parsed
+		}
+		errorCount := len(d.errors)
+		d.decodeValue(fieldPath, value, target.Field(i))
+		if len(d.errors) == errorCount {
+			d.validate(fieldPath, field.Tag, target.Field(i))
+		}
+	}
+}
+
+// lookupConfigKey finds a key by exact name, falling back to a case insensitive match.
+func lookupConfigKey(values map[string]interface{}, name string) (string, interface{}, bool) {
+	if key := matchName(name, sortedStringKeys(values)); key != "" {
+		return key, values[key], true
+	}
+	return name, nil, false
+}
+
+func parseConfigDefault(value string, fieldType reflect.Type) (interface{}, error) {
+	for fieldType.Kind() == reflect.Ptr {
+		fieldType = fieldType.Elem()
+	}
+	if fieldType == durationType {
+		return value, nil
+	}
+	switch fieldType.Kind() {
+	case reflect.String, reflect.Interface:
+		return value, nil
+	case reflect.Bool:
+		return strconv.ParseBool(value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(value, 64)
+	}
+	return nil, fmt.Errorf("defaults are not supported for %s fields", fieldType)
+}
+
+func (d *configDecoder) decodeValue(path string, value interface{}, target reflect.Value) {
+	if target.Type() == durationType {
+		text, ok := value.(string)
+		if !ok {
+			d.fail(path, "must be a duration such as \"5m\", got %s", describeConfigValue(value))
+			return
+		}
+		duration, err := time.ParseDuration(text)
+		if err != nil {
+			d.fail(path, "must be a duration such as \"5m\", got %q", text)
+			return
+		}
+		target.SetInt(int64(duration))
+		return
+	}
+	switch target.Kind() {
+	case reflect.Ptr:
+		element := reflect.New(target.Type().Elem())
+		d.decodeValue(path, value, element.Elem())
+		target.Set(element)
+	case reflect.Interface:
+		if target.NumMethod() != 0 {
+			d.fail(path, "cannot decode into %s", target.Type())
+			return
+		}
+		target.Set(reflect.ValueOf(value))
+	case reflect.String:
+		text, ok := value.(string)
+		if !ok {
+			d.fail(path, "must be a string, got %s", describeConfigValue(value))
+			return
+		}
+		target.SetString(text)
+	case reflect.Bool:
+		boolean, ok := value.(bool)
+		if !ok {
+			d.fail(path, "must be true or false, got %s", describeConfigValue(value))
+			return
+		}
+		target.SetBool(boolean)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		number, ok := configNumber(value)
+		if !ok || number != float64(int64(number)) || target.OverflowInt(int64(number)) {
+			d.fail(path, "must be a whole number that fits in %s, got %s", target.Type(), describeConfigValue(value))
+			return
+		}
+		target.SetInt(int64(number))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		number, ok := configNumber(value)
+		if !ok || number < 0 || number != float64(uint64(number)) || target.OverflowUint(uint64(number)) {
+			d.fail(path, "must be a non-negative whole number that fits in %s, got %s", target.Type(), describeConfigValue(value))
+			return
+		}
+		target.SetUint(uint64(number))
+	case reflect.Float32, reflect.Float64:
+		number, ok := configNumber(value)
+		if !ok {
+			d.fail(path, "must be a number, got %s", describeConfigValue(value))
+			return
+		}
+		target.SetFloat(number)
+	case reflect.Slice:
+		items, ok := value.([]interface{})
+		if !ok {
+			d.fail(path, "must be a list, got %s", describeConfigValue(value))
+			return
+		}
+		slice := reflect.MakeSlice(target.Type(), len(items), len(items))
+		for i, item := range items {
+			d.decodeValue(fmt.Sprintf("%s[%d]", path, i), item, slice.Index(i))
+		}
+		target.Set(slice)
+	case reflect.Map:
+		entries, ok := value.(map[string]interface{})
+		if !ok {
+			d.fail(path, "must be a map, got %s", describeConfigValue(value))
+			return
+		}
+		if target.Type().Key().Kind() != reflect.String {
+			d.fail(path, "cannot decode into %s", target.Type())
+			return
+		}
+		result := reflect.MakeMapWithSize(target.Type(), len(entries))
+		for key, entry := range entries {
+			element := reflect.New(target.Type().Elem()).Elem()
+			d.decodeValue(path+"."+key, entry, element)
+			result.SetMapIndex(reflect.ValueOf(key).Convert(target.Type().Key()), element)
+		}
+		target.Set(result)
+	case reflect.Struct:
+		entries, ok := value.(map[string]interface{})
+		if !ok {
+			d.fail(path, "must be a map, got %s", describeConfigValue(value))
+			return
+		}
+		d.decodeStruct(path, entries, target)
+	default:
+		d.fail(path, "cannot decode into %s", target.Type())
+	}
+}
+
+func configNumber(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case float64:
+		return number, true
+	case float32:
+		return float64(number), true
+	case int:
+		return float64(number), true
+	case int64:
+		return float64(number), true
+	case uint64:
+		return float64(number), true
+	}
+	return 0, false
+}
+
+func describeConfigValue(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return fmt.Sprintf("%q", value)
+	case bool, float64, float32, int, int64, uint64:
+		return fmt.Sprint(value)
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}:
+		return "a map"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// validate checks the enum, pattern, min and max rules for a decoded value.
+func (d *configDecoder) validate(path string, tag reflect.StructTag, value reflect.Value) {
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return
+		}
+		value = value.Elem()
+	}
+	if enum, ok := tag.Lookup("enum"); ok {
+		allowed := strings.Split(enum, ",")
+		actual := fmt.Sprint(value.Interface())
+		found := false
+		for _, option := range allowed {
+			if option == actual {
+				found = true
+				break
+			}
+		}
+		if !found {
+			d.fail(path, "must be one of %s, got %q", strings.Join(allowed, ", "), actual)
+		}
+	}
+	if pattern, ok := tag.Lookup("pattern"); ok && value.Kind() == reflect.String {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			d.fail(path, "invalid pattern %q: %s", pattern, err)
+		} else if !re.MatchString(value.String()) {
+			d.fail(path, "must match %s, got %q", pattern, value.String())
+		}
+	}
+	d.validateBound(path, tag, "min", value)
+	d.validateBound(path, tag, "max", value)
+}
+
+func (d *configDecoder) validateBound(path string, tag reflect.StructTag, name string, value reflect.Value) {
+	bound, ok := tag.Lookup(name)
+	if !ok {
+		return
+	}
+	var limit, actual float64
+	var unit string
+	var err error
+	switch {
+	case value.Type() == durationType:
+		var duration time.Duration
+		duration, err = time.ParseDuration(bound)
+		limit, actual = float64(duration), float64(value.Int())
+	case value.Kind() == reflect.String:
+		limit, err = strconv.ParseFloat(bound, 64)
+		actual, unit = float64(len(value.String())), " characters"
+	case value.Kind() == reflect.Slice, value.Kind() == reflect.Map:
+		limit, err = strconv.ParseFloat(bound, 64)
+		actual, unit = float64(value.Len()), " items"
+	default:
+		var ok bool
+		limit, err = strconv.ParseFloat(bound, 64)
+		if actual, ok = configNumber(reflectNumber(value)); !ok {
+			d.fail(path, "%s is not supported for %s", name, value.Type())
+			return
+		}
+	}
+	if err != nil {
+		d.fail(path, "invalid %s %q: %s", name, bound, err)
+		return
+	}
+	if name == "min" && actual < limit {
+		d.fail(path, "must be at least %s%s, got %s", bound, unit, describeBoundValue(value))
+	} else if name == "max" && actual > limit {
+		d.fail(path, "must be at most %s%s, got %s", bound, unit, describeBoundValue(value))
+	}
+}
+
+func reflectNumber(value reflect.Value) interface{} {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return value.Uint()
+	case reflect.Float32, reflect.Float64:
+		return value.Float()
+	}
+	return nil
+}
+
+func describeBoundValue(value reflect.Value) string {
+	switch value.Kind() {
+	case reflect.String:
+		return strconv.Itoa(len(value.String()))
+	case reflect.Slice, reflect.Map:
+		return strconv.Itoa(value.Len())
+	}
+	return fmt.Sprint(value.Interface())
+}
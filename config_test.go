@@ -0,0 +1,98 @@
+package common_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+type testBucketConfig struct {
+	Name    string `config:"name" required:"true" pattern:"^[a-z0-9-]+$"`
+	Public  bool   `config:"public"`
+	Retries int    `config:"retries" default:"3" min:"0" max:"5"`
+}
+
+type testConfig struct {
+	Region  string             `config:"region" default:"eu-west-1" enum:"eu-west-1,us-east-1"`
+	Timeout time.Duration      `config:"timeout" default:"5m" max:"1h"`
+	Buckets []testBucketConfig `config:"buckets" min:"1"`
+	Tags    map[string]string  `config:"tags"`
+	Account *string            `config:"account"`
+	Ignored string             `config:"-"`
+}
+
+func decodeJSONConfig(t *testing.T, data string) map[string]interface{} {
+	t.Helper()
+	var config map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &config); err != nil {
+		t.Fatal("error parsing config:", err)
+	}
+	return config
+}
+
+func TestDecodeConfig(t *testing.T) {
+	// Given
+	config := decodeJSONConfig(t, `{
+		"timeout": "10m",
+		"buckets": [{"name": "assets", "public": true}, {"name": "logs", "retries": 0}],
+		"tags": {"team": "platform"},
+		"account": "123"
+	}`)
+
+	// When
+	var result testConfig
+	if err := common.DecodeConfig(config, &result); err != nil {
+		t.Fatal("error decoding config:", err)
+	}
+
+	// Then
+	account := "123"
+	expected := testConfig{
+		Region:  "eu-west-1",
+		Timeout: 10 * time.Minute,
+		Buckets: []testBucketConfig{{Name: "assets", Public: true, Retries: 3}, {Name: "logs", Retries: 0}},
+		Tags:    map[string]string{"team": "platform"},
+		Account: &account,
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("got %+v, wanted %+v", result, expected)
+	}
+}
+
+func TestDecodeConfigErrors(t *testing.T) {
+	// Given
+	config := decodeJSONConfig(t, `{
+		"region": "mars-north-1",
+		"timeout": 30,
+		"buckets": [{"public": "yes"}, {"name": "Bad_Name", "retries": 2.5}, {"name": "ok", "retries": 9}]
+	}`)
+
+	// When
+	var result testConfig
+	err := common.DecodeConfig(config, &result)
+
+	// Then
+	errs, ok := err.(common.ConfigErrors)
+	if !ok {
+		t.Fatalf("expected ConfigErrors, got %v", err)
+	}
+	expected := []string{
+		`config.region: must be one of eu-west-1, us-east-1, got "mars-north-1"`,
+		`config.timeout: must be a duration such as "5m", got 30`,
+		`config.buckets[0].name: is required`,
+		`config.buckets[0].public: must be true or false, got "yes"`,
+		`config.buckets[1].name: must match ^[a-z0-9-]+$, got "Bad_Name"`,
+		`config.buckets[1].retries: must be a whole number that fits in int, got 2.5`,
+		`config.buckets[2].retries: must be at most 5, got 9`,
+	}
+	var actual []string
+	for _, err := range errs {
+		actual = append(actual, err.Error())
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("got:\n%q\nwanted:\n%q", actual, expected)
+	}
+}
@@ -0,0 +1,200 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// CredentialScope is what a credential is issued for - a build of a release, or a deploy of a release to an
+// environment.
+type CredentialScope struct {
+	Team      string
+	Component string
+	Version   string
+	// BuildID and Needs are set for a build, from ReleaseRequirements.
+	BuildID string
+	Needs   []string
+	// EnvName is set for a deploy.
+	EnvName string
+}
+
+// Credential is a short-lived credential, passed to a build or deploy as environment variables.
+type Credential struct {
+	ID      string
+	Env     map[string]string
+	Expires time.Time
+}
+
+// CredentialIssuer mints scoped, expiring credentials for builds and deploys.
+type CredentialIssuer interface {
+	Issue(scope *CredentialScope) (*Credential, error)
+	Revoke(credential *Credential) error
+}
+
+// credentialTracker keeps the credentials issued while listening, so they can be revoked when it stops.
+type credentialTracker struct {
+	issuer      CredentialIssuer
+	mutex       sync.Mutex
+	credentials []*Credential
+}
+
+func (t *credentialTracker) issue(scope *CredentialScope) (*Credential, error) {
+	credential, err := t.issuer.Issue(scope)
+	if err != nil {
+		return nil, err
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	active := t.credentials[:0]
+	for _, existing := range t.credentials {
+		if now.Before(existing.Expires) {
+			active = append(active, existing)
+		}
+	}
+	t.credentials = append(active, credential)
+	return credential, nil
+}
+
+// revokeAll revokes the credentials that have not yet expired, logging any that could not be revoked.
+func (t *credentialTracker) revokeAll() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	for _, credential := range t.credentials {
+		if !now.Before(credential.Expires) {
+			continue
+		}
+		if err := t.issuer.Revoke(credential); err != nil {
+			log.Printf("error revoking credential %s: %s", credential.ID, err)
+		}
+	}
+	t.credentials = nil
+}
+
+// issueBuildCredentials adds a credential to the env of each build in the release requirements.
+func (t *credentialTracker) issueBuildCredentials(request *ConfigureReleaseRequest, response *ConfigureReleaseResponse) ([]*Credential, error) {
+	var result []*Credential
+	for _, buildID := range sortedStringKeys(request.ReleaseRequirements) {
+		scope := &CredentialScope{
+			Team:      request.Team,
+			Component: request.Component,
+			Version:   request.Version,
+			BuildID:   buildID,
+		}
+		if requirements := request.ReleaseRequirements[buildID]; requirements != nil {
+			scope.Needs = requirements.Needs
+		}
+		credential, err := t.issue(scope)
+		if err != nil {
+			return result, fmt.Errorf("error issuing credential for build %s: %s", buildID, err)
+		}
+		if response.Env[buildID] == nil {
+			response.Env[buildID] = make(map[string]string)
+		}
+		for name, value := range credential.Env {
+			response.Env[buildID][name] = value
+		}
+		result = append(result, credential)
+	}
+	return result, nil
+}
+
+// issueDeployCredential adds a credential for the environment to the env of a prepare terraform response.
+func (t *credentialTracker) issueDeployCredential(request *PrepareTerraformRequest, response *PrepareTerraformResponse) (*Credential, error) {
+	credential, err := t.issue(&CredentialScope{
+		Team:      request.Team,
+		Component: request.Component,
+		Version:   request.Version,
+		EnvName:   request.EnvName,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error issuing credential for %s: %s", request.EnvName, err)
+	}
+	if response.Env == nil {
+		response.Env = make(map[string]string)
+	}
+	for name, value := range credential.Env {
+		response.Env[name] = value
+	}
+	return credential, nil
+}
+
+// LocalCredentialIssuer issues random tokens that it can check itself, for testing handlers and config containers.
+type LocalCredentialIssuer struct {
+	TTL    time.Duration
+	mutex  sync.Mutex
+	issued map[string]*localCredential
+}
+
+type localCredential struct {
+	scope   *CredentialScope
+	token   string
+	expires time.Time
+	revoked bool
+}
+
+// LocalCredentialEnvVar is the variable a LocalCredentialIssuer puts its tokens in.
+const LocalCredentialEnvVar = "CDFLOW2_CREDENTIAL_TOKEN"
+
+// CreateLocalCredentialIssuer returns a LocalCredentialIssuer whose credentials last for ttl.
+func CreateLocalCredentialIssuer(ttl time.Duration) *LocalCredentialIssuer {
+	return &LocalCredentialIssuer{TTL: ttl, issued: make(map[string]*localCredential)}
+}
+
+// Issue mints a random token for the scope.
+func (i *LocalCredentialIssuer) Issue(scope *CredentialScope) (*Credential, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	token, err := randomHex(24)
+	if err != nil {
+		return nil, err
+	}
+	expires := time.Now().Add(i.TTL)
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.issued[id] = &localCredential{scope: scope, token: token, expires: expires}
+	return &Credential{ID: id, Env: map[string]string{LocalCredentialEnvVar: token}, Expires: expires}, nil
+}
+
+// Revoke revokes a credential, so it is no longer valid.
+func (i *LocalCredentialIssuer) Revoke(credential *Credential) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	issued, ok := i.issued[credential.ID]
+	if !ok {
+		return errors.New("unknown credential " + credential.ID)
+	}
+	issued.revoked = true
+	return nil
+}
+
+// Check returns the scope of a token if it is valid - issued, not expired and not revoked.
+func (i *LocalCredentialIssuer) Check(token string) (*CredentialScope, bool) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	for _, issued := range i.issued {
+		if issued.token == token {
+			if issued.revoked || !time.Now().Before(issued.expires) {
+				return nil, false
+			}
+			return issued.scope, true
+		}
+	}
+	return nil, false
+}
+
+func randomHex(size int) (string, error) {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data), nil
+}
@@ -0,0 +1,139 @@
+package common_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func TestListenIssuesAndRevokesCredentials(t *testing.T) {
+	// Given
+	socketPath := tempSock(t)
+	defer os.Remove(socketPath)
+	sigtermChannel := make(chan os.Signal, 1)
+	issuer := common.CreateLocalCredentialIssuer(time.Hour)
+	done := make(chan struct{})
+	go func() {
+		common.ListenWithOptions(&stubHandler{}, socketPath, releaseDir(t), sigtermChannel, &common.ListenOptions{
+			CredentialIssuer: issuer,
+		})
+		close(done)
+	}()
+
+	// When
+	configureResponse, err := forward(map[string]interface{}{
+		"Action":    "configure_release",
+		"Component": "test-component",
+		"Version":   "1",
+		"Team":      "test-team",
+		"ReleaseRequirements": map[string]interface{}{
+			"app": map[string]interface{}{"Needs": []string{"lambda"}},
+		},
+	}, socketPath)
+	if err != nil {
+		t.Fatal("error calling configure release:", err)
+	}
+	prepareResponse, err := forward(map[string]interface{}{
+		"Action":    "prepare_terraform",
+		"Component": "test-component",
+		"Version":   "1",
+		"EnvName":   "live",
+	}, socketPath)
+	if err != nil {
+		t.Fatal("error calling prepare terraform:", err)
+	}
+	buildToken := configureResponse["Env"].(map[string]interface{})["app"].(map[string]interface{})[common.LocalCredentialEnvVar].(string)
+	deployToken := prepareResponse["Env"].(map[string]interface{})[common.LocalCredentialEnvVar].(string)
+	buildScope, buildValid := issuer.Check(buildToken)
+	deployScope, deployValid := issuer.Check(deployToken)
+	sigtermChannel <- FakeSigterm{}
+	<-done
+
+	// Then
+	if !buildValid || buildScope.BuildID != "app" || buildScope.Needs[0] != "lambda" || buildScope.Team != "test-team" {
+		t.Fatalf("unexpected build credential scope: %+v", buildScope)
+	}
+	if !deployValid || deployScope.EnvName != "live" || deployScope.Component != "test-component" {
+		t.Fatalf("unexpected deploy credential scope: %+v", deployScope)
+	}
+	if _, valid := issuer.Check(buildToken); valid {
+		t.Fatal("expected build credential to be revoked when Listen stopped")
+	}
+	if _, valid := issuer.Check(deployToken); valid {
+		t.Fatal("expected deploy credential to be revoked when Listen stopped")
+	}
+}
+
+// failingCredentialIssuer issues one credential then fails, recording the credentials it revokes in a file.
+type failingCredentialIssuer struct {
+	issued      int
+	revokedFile string
+}
+
+func (i *failingCredentialIssuer) Issue(scope *common.CredentialScope) (*common.Credential, error) {
+	i.issued++
+	if i.issued > 1 {
+		return nil, errors.New("issuer unavailable")
+	}
+	return &common.Credential{ID: "credential-" + scope.BuildID, Expires: time.Now().Add(time.Hour)}, nil
+}
+
+func (i *failingCredentialIssuer) Revoke(credential *common.Credential) error {
+	f, err := os.OpenFile(i.revokedFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(credential.ID + "\n")
+	return err
+}
+
+func TestListenRevokesCredentialsWhenIssuingFails(t *testing.T) {
+	if revokedFile := os.Getenv("CDFLOW2_TEST_REVOKED_FILE"); revokedFile != "" {
+		socketPath := tempSock(t)
+		defer os.Remove(socketPath)
+		go common.ListenWithOptions(&stubHandler{}, socketPath, releaseDir(t), make(chan os.Signal, 1), &common.ListenOptions{
+			CredentialIssuer: &failingCredentialIssuer{revokedFile: revokedFile},
+		})
+		forward(map[string]interface{}{
+			"Action":              "configure_release",
+			"ReleaseRequirements": map[string]interface{}{"a": map[string]interface{}{}, "b": map[string]interface{}{}},
+		}, socketPath)
+		t.Fatal("expected Listen to exit")
+	}
+
+	// Given
+	dir, err := ioutil.TempDir("", "cdflow2-config-common-test-credentials")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	defer os.RemoveAll(dir)
+	revokedFile := filepath.Join(dir, "revoked")
+	command := exec.Command(os.Args[0], "-test.run=^TestListenRevokesCredentialsWhenIssuingFails$")
+	command.Env = append(os.Environ(), "CDFLOW2_TEST_REVOKED_FILE="+revokedFile)
+
+	// When
+	output, err := command.CombinedOutput()
+
+	// Then
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.Success() {
+		t.Fatalf("expected Listen to exit with an error, got %v: %s", err, output)
+	}
+	if !strings.Contains(string(output), "error issuing credential for build b: issuer unavailable") {
+		t.Fatalf("unexpected output: %s", output)
+	}
+	revoked, err := ioutil.ReadFile(revokedFile)
+	if err != nil {
+		t.Fatal("error reading revoked credentials:", err)
+	}
+	if string(revoked) != "credential-a\n" {
+		t.Fatalf("unexpected revoked credentials: %q", revoked)
+	}
+}
@@ -0,0 +1,312 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// encryptedReleaseMagic identifies an encrypted release and the version of the encryption format.
+var encryptedReleaseMagic = []byte("cdflow2-enc\x01")
+
+const (
+	dataKeySize          = 32
+	noncePrefixSize      = 7
+	encryptedChunkSize   = 64 * 1024
+	encryptedChunkLength = encryptedChunkSize + 16 // plus the GCM tag
+)
+
+// ErrReleaseNotEncrypted is returned when decrypting a release that was not encrypted.
+var ErrReleaseNotEncrypted = errors.New("release is not encrypted")
+
+// EncryptRelease encrypts a release with a random AES-256-GCM data key, which is stored alongside it wrapped by the key wrapper.
+//
+// The release is split into chunks that are each sealed separately, so that it can be streamed rather than held in memory.
+func EncryptRelease(writer io.Writer, reader io.Reader, keyWrapper KeyWrapper) error {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	wrappedKey, err := keyWrapper.WrapKey(dataKey)
+	if err != nil {
+		return fmt.Errorf("error wrapping release data key: %s", err)
+	}
+	if len(wrappedKey) > 0xffff {
+		return fmt.Errorf("wrapped release data key too long: %d bytes", len(wrappedKey))
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+
+	var header bytes.Buffer
+	header.Write(encryptedReleaseMagic)
+	binary.Write(&header, binary.BigEndian, uint16(len(wrappedKey)))
+	header.Write(wrappedKey)
+	noncePrefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(noncePrefix); err != nil {
+		return err
+	}
+	header.Write(noncePrefix)
+	if _, err := writer.Write(header.Bytes()); err != nil {
+		return err
+	}
+
+	bufferedReader := bufio.NewReaderSize(reader, encryptedChunkSize)
+	chunk := make([]byte, encryptedChunkSize)
+	sealed := make([]byte, 0, encryptedChunkLength)
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(bufferedReader, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := err != nil
+		if !last {
+			if _, err := bufferedReader.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+		sealed = aead.Seal(sealed[:0], chunkNonce(noncePrefix, counter, last), chunk[:n], header.Bytes())
+		if _, err := writer.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		if counter == ^uint32(0) {
+			return errors.New("release too large to encrypt")
+		}
+	}
+}
+
+// DecryptRelease returns a reader for the decrypted contents of a release encrypted with EncryptRelease.
+func DecryptRelease(reader io.Reader, keyWrapper KeyWrapper) (io.Reader, error) {
+	bufferedReader := bufio.NewReaderSize(reader, encryptedChunkLength)
+
+	var header bytes.Buffer
+	magic := make([]byte, len(encryptedReleaseMagic))
+	if _, err := io.ReadFull(bufferedReader, magic); err != nil || !bytes.Equal(magic, encryptedReleaseMagic) {
+		return nil, ErrReleaseNotEncrypted
+	}
+	header.Write(magic)
+	var wrappedKeyLength uint16
+	if err := binary.Read(bufferedReader, binary.BigEndian, &wrappedKeyLength); err != nil {
+		return nil, fmt.Errorf("error reading encrypted release header: %s", err)
+	}
+	binary.Write(&header, binary.BigEndian, wrappedKeyLength)
+	wrappedKey := make([]byte, wrappedKeyLength)
+	if _, err := io.ReadFull(bufferedReader, wrappedKey); err != nil {
+		return nil, fmt.Errorf("error reading encrypted release header: %s", err)
+	}
+	header.Write(wrappedKey)
+	noncePrefix := make([]byte, noncePrefixSize)
+	if _, err := io.ReadFull(bufferedReader, noncePrefix); err != nil {
+		return nil, fmt.Errorf("error reading encrypted release header: %s", err)
+	}
+	header.Write(noncePrefix)
+
+	dataKey, err := keyWrapper.UnwrapKey(wrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping release data key: %s", err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptingReader{
+		reader:         bufferedReader,
+		aead:           aead,
+		noncePrefix:    noncePrefix,
+		additionalData: header.Bytes(),
+		sealed:         make([]byte, encryptedChunkLength),
+	}, nil
+}
+
+type decryptingReader struct {
+	reader         *bufio.Reader
+	aead           cipher.AEAD
+	noncePrefix    []byte
+	additionalData []byte
+	counter        uint32
+	sealed         []byte
+	plaintext      []byte
+	done           bool
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.plaintext) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plaintext)
+	r.plaintext = r.plaintext[n:]
+	return n, nil
+}
+
+func (r *decryptingReader) readChunk() error {
+	n, err := io.ReadFull(r.reader, r.sealed)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := err != nil
+	if !last {
+		if _, err := r.reader.Peek(1); err == io.EOF {
+			last = true
+		}
+	}
+	plaintext, err := r.aead.Open(r.sealed[:0], chunkNonce(r.noncePrefix, r.counter, last), r.sealed[:n], r.additionalData)
+	if err != nil {
+		return fmt.Errorf("error decrypting release (corrupt, truncated or wrong key): %s", err)
+	}
+	r.plaintext = plaintext
+	r.done = last
+	r.counter++
+	return nil
+}
+
+// chunkNonce derives the nonce for a chunk, marking the last chunk so truncation is detected.
+func chunkNonce(noncePrefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, noncePrefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("expected %d byte key, got %d bytes", dataKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type fileKeyWrapper struct {
+	aead cipher.AEAD
+}
+
+// CreateFileKeyWrapper returns a KeyWrapper that wraps data keys with a base64 encoded 256 bit key read from a local file.
+func CreateFileKeyWrapper(path string) (KeyWrapper, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file %q: %s", path, err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding key file %q: %s", path, err)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in %q: %s", path, err)
+	}
+	return &fileKeyWrapper{aead: aead}, nil
+}
+
+// WrapKey encrypts a data key, returning the nonce followed by the ciphertext.
+func (w *fileKeyWrapper) WrapKey(dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, w.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return w.aead.Seal(nonce, nonce, dataKey, nil), nil
+}
+
+// UnwrapKey decrypts a data key wrapped by WrapKey.
+func (w *fileKeyWrapper) UnwrapKey(wrappedKey []byte) ([]byte, error) {
+	nonceSize := w.aead.NonceSize()
+	if len(wrappedKey) < nonceSize {
+		return nil, errors.New("wrapped key too short")
+	}
+	return w.aead.Open(nil, wrappedKey[:nonceSize], wrappedKey[nonceSize:], nil)
+}
+
+type encryptingReleaseSaver struct {
+	saver      ReleaseSaver
+	keyWrapper KeyWrapper
+}
+
+// CreateEncryptingReleaseSaver returns a ReleaseSaver that encrypts the releases saved by another ReleaseSaver.
+func CreateEncryptingReleaseSaver(saver ReleaseSaver, keyWrapper KeyWrapper) ReleaseSaver {
+	return &encryptingReleaseSaver{saver: saver, keyWrapper: keyWrapper}
+}
+
+// Save returns a reader for the encrypted release archive.
+func (s *encryptingReleaseSaver) Save(
+	component, version, terraformImage, releaseDir string,
+) (io.ReadCloser, error) {
+	release, err := s.saver.Save(component, version, terraformImage, releaseDir)
+	if err != nil {
+		return nil, err
+	}
+	return s.encrypt(release), nil
+}
+
+// SaveWithInfo returns a reader for the encrypted release archive, including the release info.
+func (s *encryptingReleaseSaver) SaveWithInfo(
+	releaseInfo *ReleaseInfo, releaseDir string,
+) (io.ReadCloser, error) {
+	release, err := saveReleaseWithInfo(s.saver, releaseInfo, releaseDir)
+	if err != nil {
+		return nil, err
+	}
+	return s.encrypt(release), nil
+}
+
+func (s *encryptingReleaseSaver) encrypt(release io.ReadCloser) io.ReadCloser {
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		defer release.Close()
+		pipeWriter.CloseWithError(EncryptRelease(pipeWriter, release, s.keyWrapper))
+	}()
+	return pipeReader
+}
+
+type decryptingReleaseLoader struct {
+	loader     ReleaseLoader
+	keyWrapper KeyWrapper
+}
+
+// CreateDecryptingReleaseLoader returns a ReleaseLoader that decrypts releases before passing them to another ReleaseLoader.
+func CreateDecryptingReleaseLoader(loader ReleaseLoader, keyWrapper KeyWrapper) ReleaseLoader {
+	return &decryptingReleaseLoader{loader: loader, keyWrapper: keyWrapper}
+}
+
+// Load decrypts and unpacks a release into a release directory.
+func (l *decryptingReleaseLoader) Load(
+	reader io.Reader, component, version, releaseDir string,
+) (string, error) {
+	decrypted, err := DecryptRelease(reader, l.keyWrapper)
+	if err != nil {
+		return "", err
+	}
+	return l.loader.Load(decrypted, component, version, releaseDir)
+}
+
+// LoadWithInfo decrypts and unpacks a release into a release directory, returning the release info stored in it.
+func (l *decryptingReleaseLoader) LoadWithInfo(
+	reader io.Reader, component, version, releaseDir string,
+) (*ReleaseInfo, error) {
+	decrypted, err := DecryptRelease(reader, l.keyWrapper)
+	if err != nil {
+		return nil, err
+	}
+	return loadReleaseWithInfo(l.loader, decrypted, component, version, releaseDir)
+}
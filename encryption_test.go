@@ -0,0 +1,145 @@
+package common_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func createKeyWrapper(t *testing.T) common.KeyWrapper {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal("error generating key:", err)
+	}
+	file, err := ioutil.TempFile("", "cdflow2-config-common-test-key")
+	if err != nil {
+		t.Fatal("error creating key file:", err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(base64.StdEncoding.EncodeToString(key) + "\n"); err != nil {
+		t.Fatal("error writing key file:", err)
+	}
+	file.Close()
+	keyWrapper, err := common.CreateFileKeyWrapper(file.Name())
+	if err != nil {
+		t.Fatal("error creating key wrapper:", err)
+	}
+	return keyWrapper
+}
+
+func TestEncryptDecryptRelease(t *testing.T) {
+	keyWrapper := createKeyWrapper(t)
+	for _, size := range []int{0, 1, 64 * 1024, 64*1024 + 1, 200 * 1024} {
+		// Given
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+		var encrypted bytes.Buffer
+
+		// When
+		if err := common.EncryptRelease(&encrypted, bytes.NewReader(plaintext), keyWrapper); err != nil {
+			t.Fatal("error encrypting release:", err)
+		}
+		reader, err := common.DecryptRelease(bytes.NewReader(encrypted.Bytes()), keyWrapper)
+		if err != nil {
+			t.Fatal("error decrypting release:", err)
+		}
+		decrypted, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("error reading decrypted release of size %d: %v", size, err)
+		}
+
+		// Then
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Fatalf("decrypted release of size %d does not match", size)
+		}
+		if size >= 16 && bytes.Contains(encrypted.Bytes(), plaintext) {
+			t.Fatal("encrypted release contains the plaintext")
+		}
+	}
+}
+
+func TestDecryptReleaseDetectsTruncation(t *testing.T) {
+	// Given
+	keyWrapper := createKeyWrapper(t)
+	plaintext := make([]byte, 150*1024)
+	var encrypted bytes.Buffer
+	if err := common.EncryptRelease(&encrypted, bytes.NewReader(plaintext), keyWrapper); err != nil {
+		t.Fatal("error encrypting release:", err)
+	}
+	// drop the final chunk, leaving two complete chunks
+	truncated := encrypted.Bytes()[:encrypted.Len()-(150*1024-2*64*1024+16)]
+
+	// When
+	reader, err := common.DecryptRelease(bytes.NewReader(truncated), keyWrapper)
+	if err != nil {
+		t.Fatal("error decrypting release:", err)
+	}
+	_, err = io.Copy(ioutil.Discard, reader)
+
+	// Then
+	if err == nil {
+		t.Fatal("expected error reading truncated release")
+	}
+}
+
+func TestDecryptReleaseWithWrongKey(t *testing.T) {
+	// Given
+	var encrypted bytes.Buffer
+	if err := common.EncryptRelease(&encrypted, bytes.NewReader([]byte("release")), createKeyWrapper(t)); err != nil {
+		t.Fatal("error encrypting release:", err)
+	}
+
+	// When
+	_, err := common.DecryptRelease(bytes.NewReader(encrypted.Bytes()), createKeyWrapper(t))
+
+	// Then
+	if err == nil {
+		t.Fatal("expected error decrypting with the wrong key")
+	}
+}
+
+func TestDecryptReleaseNotEncrypted(t *testing.T) {
+	_, err := common.DecryptRelease(bytes.NewReader([]byte("PK\x03\x04 plain zip")), createKeyWrapper(t))
+	if err != common.ErrReleaseNotEncrypted {
+		t.Fatalf("got %v, wanted %v", err, common.ErrReleaseNotEncrypted)
+	}
+}
+
+func TestEncryptingReleaseSaverAndDecryptingReleaseLoader(t *testing.T) {
+	// Given
+	keyWrapper := createKeyWrapper(t)
+	saver := common.CreateEncryptingReleaseSaver(common.CreateReleaseSaver(), keyWrapper)
+	loader := common.CreateDecryptingReleaseLoader(common.CreateReleaseLoader(), keyWrapper)
+	dir, err := ioutil.TempDir("", "cdflow2-config-common-test-encrypted-release")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// When
+	release, err := saver.Save("test-component", "test-version", "test-terraform-image", releaseDir(t))
+	if err != nil {
+		t.Fatal("error saving release:", err)
+	}
+	defer release.Close()
+	terraformImage, err := loader.Load(release, "test-component", "test-version", dir)
+	if err != nil {
+		t.Fatal("error loading release:", err)
+	}
+
+	// Then
+	if terraformImage != "test-terraform-image" {
+		t.Fatalf("got %q, wanted %q", terraformImage, "test-terraform-image")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "test.txt")); err != nil || string(data) != "test" {
+		t.Fatalf("problem reading file, data: %v, error: %v\n", data, err)
+	}
+}
@@ -0,0 +1,285 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const fileReleaseStoreExtension = ".zip"
+
+type fileReleaseStore struct {
+	dir string
+}
+
+// CreateFileReleaseStore returns a ReleaseStore that keeps releases in a local directory, laid out as
+// {component}/{version}.zip (whatever the archive format - it is detected when the release is loaded).
+func CreateFileReleaseStore(dir string) ReleaseStore {
+	return &fileReleaseStore{dir: dir}
+}
+
+func (s *fileReleaseStore) path(component, version string) string {
+	return filepath.Join(s.dir, component, version+fileReleaseStoreExtension)
+}
+
+// Put writes the release to a temporary file and renames it into place, so readers never see a partial release.
+func (s *fileReleaseStore) Put(component, version string, release io.Reader) error {
+	if err := ValidateReleaseKey(component, version); err != nil {
+		return err
+	}
+	componentDir := filepath.Join(s.dir, component)
+	if err := os.MkdirAll(componentDir, 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(componentDir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := io.Copy(file, release); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), s.path(component, version))
+}
+
+func (s *fileReleaseStore) Get(component, version string) (io.ReadCloser, error) {
+	if err := ValidateReleaseKey(component, version); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(s.path(component, version))
+	if os.IsNotExist(err) {
+		return nil, ErrReleaseNotFound
+	}
+	return file, err
+}
+
+func (s *fileReleaseStore) Exists(component, version string) (bool, error) {
+	if err := ValidateReleaseKey(component, version); err != nil {
+		return false, err
+	}
+	_, err := os.Stat(s.path(component, version))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *fileReleaseStore) List(component string) ([]*StoredRelease, error) {
+	components := []string{component}
+	if component == "" {
+		var err error
+		if components, err = listDirNames(s.dir, true); err != nil {
+			return nil, err
+		}
+	} else if err := validateReleaseKeyPart("component", component); err != nil {
+		return nil, err
+	}
+	var result []*StoredRelease
+	for _, component := range components {
+		files, err := ioutil.ReadDir(filepath.Join(s.dir, component))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			name := file.Name()
+			if file.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, fileReleaseStoreExtension) {
+				continue
+			}
+			result = append(result, &StoredRelease{
+				Component:    component,
+				Version:      strings.TrimSuffix(name, fileReleaseStoreExtension),
+				Size:         file.Size(),
+				LastModified: file.ModTime(),
+			})
+		}
+	}
+	sortStoredReleases(result)
+	return result, nil
+}
+
+func (s *fileReleaseStore) Delete(component, version string) error {
+	if err := ValidateReleaseKey(component, version); err != nil {
+		return err
+	}
+	err := os.Remove(s.path(component, version))
+	if os.IsNotExist(err) {
+		return ErrReleaseNotFound
+	}
+	return err
+}
+
+// listDirNames returns the names of the entries in a directory, optionally only the directories.
+func listDirNames(dir string, dirsOnly bool) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), ".") || (dirsOnly && !file.IsDir()) {
+			continue
+		}
+		result = append(result, file.Name())
+	}
+	return result, nil
+}
+
+func (s *fileReleaseStore) uploadDir(component, uploadID string) string {
+	return filepath.Join(s.dir, component, ".upload-"+uploadID)
+}
+
+// checkUpload returns ErrUploadNotFound if the staging directory for an upload does not exist.
+func (s *fileReleaseStore) checkUpload(component, uploadID string) error {
+	if _, err := os.Stat(s.uploadDir(component, uploadID)); os.IsNotExist(err) {
+		return ErrUploadNotFound
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// BeginUpload creates a staging directory for the chunks of an upload.
+func (s *fileReleaseStore) BeginUpload(component, version string) (string, error) {
+	if err := ValidateReleaseKey(component, version); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Join(s.dir, component), 0755); err != nil {
+		return "", err
+	}
+	dir, err := ioutil.TempDir(filepath.Join(s.dir, component), ".upload-")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(filepath.Base(dir), ".upload-"), nil
+}
+
+// PutChunk verifies the checksum of a chunk and writes it to the staging directory.
+func (s *fileReleaseStore) PutChunk(component, version, uploadID string, index int, chunk []byte, checksum string) (*UploadedChunk, error) {
+	if err := ValidateReleaseKey(component, version); err != nil {
+		return nil, err
+	}
+	if err := validateReleaseKeyPart("upload id", uploadID); err != nil {
+		return nil, err
+	}
+	if got := chunkChecksum(chunk); got != checksum {
+		return nil, fmt.Errorf("checksum mismatch for chunk %d, expected %s, got %s", index, checksum, got)
+	}
+	if err := s.checkUpload(component, uploadID); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(s.uploadDir(component, uploadID), strconv.Itoa(index)), chunk); err != nil {
+		return nil, err
+	}
+	return &UploadedChunk{Index: index, Checksum: checksum}, nil
+}
+
+// CompleteUpload joins the chunks, checking each against its checksum, and renames the result into place.
+func (s *fileReleaseStore) CompleteUpload(component, version, uploadID string, chunks []*UploadedChunk) error {
+	if err := ValidateReleaseKey(component, version); err != nil {
+		return err
+	}
+	if err := validateReleaseKeyPart("upload id", uploadID); err != nil {
+		return err
+	}
+	if err := s.checkUpload(component, uploadID); err != nil {
+		return err
+	}
+	for i, chunk := range chunks {
+		if chunk.Index != i {
+			return fmt.Errorf("missing chunk %d", i)
+		}
+	}
+	uploadDir := s.uploadDir(component, uploadID)
+	release := &uploadedChunksReader{dir: uploadDir, chunks: chunks}
+	defer release.Close()
+	if err := s.Put(component, version, release); err != nil {
+		return err
+	}
+	return os.RemoveAll(uploadDir)
+}
+
+// uploadedChunksReader streams the chunks of an upload from their files in order, without holding the release in
+// memory, returning an error at the end of any chunk that does not match its checksum.
+type uploadedChunksReader struct {
+	dir    string
+	chunks []*UploadedChunk
+	file   *os.File
+	hash   hash.Hash
+}
+
+func (r *uploadedChunksReader) Read(p []byte) (int, error) {
+	for {
+		if r.file == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			file, err := os.Open(filepath.Join(r.dir, strconv.Itoa(r.chunks[0].Index)))
+			if err != nil {
+				return 0, err
+			}
+			r.file, r.hash = file, sha256.New()
+		}
+		n, err := r.file.Read(p)
+		r.hash.Write(p[:n])
+		if err != io.EOF {
+			return n, err
+		}
+		chunk := r.chunks[0]
+		r.Close()
+		r.chunks = r.chunks[1:]
+		if got := base64.StdEncoding.EncodeToString(r.hash.Sum(nil)); got != chunk.Checksum {
+			return n, fmt.Errorf("checksum mismatch for chunk %d, expected %s, got %s", chunk.Index, chunk.Checksum, got)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *uploadedChunksReader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (s *fileReleaseStore) AbortUpload(component, version, uploadID string) error {
+	if err := ValidateReleaseKey(component, version); err != nil {
+		return err
+	}
+	if err := validateReleaseKeyPart("upload id", uploadID); err != nil {
+		return err
+	}
+	return os.RemoveAll(s.uploadDir(component, uploadID))
+}
+
+func chunkChecksum(chunk []byte) string {
+	checksum := sha256.Sum256(chunk)
+	return base64.StdEncoding.EncodeToString(checksum[:])
+}
@@ -0,0 +1,84 @@
+package common_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func TestFileReleaseStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cdflow2-config-common-test-file-store")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	testReleaseStore(t, common.CreateFileReleaseStore(dir))
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "test-component"))
+	if err != nil {
+		t.Fatal("error reading store dir:", err)
+	}
+	for _, file := range files {
+		if file.Name() != "2.zip" {
+			t.Fatal("unexpected file left in store:", file.Name())
+		}
+	}
+}
+
+func TestFileReleaseStoreChunkedUpload(t *testing.T) {
+	// Given
+	dir, err := ioutil.TempDir("", "cdflow2-config-common-test-file-store-chunked")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	defer os.RemoveAll(dir)
+	store := common.CreateFileReleaseStore(dir).(common.ChunkedReleaseStore)
+	chunks := [][]byte{bytes.Repeat([]byte("a"), 100000), []byte("b"), bytes.Repeat([]byte("c"), 5000)}
+	upload := func(version string) (string, []*common.UploadedChunk) {
+		uploadID, err := store.BeginUpload("test-component", version)
+		if err != nil {
+			t.Fatal("error beginning upload:", err)
+		}
+		var uploaded []*common.UploadedChunk
+		for i, chunk := range chunks {
+			sum := sha256.Sum256(chunk)
+			result, err := store.PutChunk("test-component", version, uploadID, i, chunk, base64.StdEncoding.EncodeToString(sum[:]))
+			if err != nil {
+				t.Fatal("error putting chunk:", err)
+			}
+			uploaded = append(uploaded, result)
+		}
+		return uploadID, uploaded
+	}
+	uploadID, uploaded := upload("1")
+	corruptUploadID, corruptUploaded := upload("2")
+	if err := ioutil.WriteFile(filepath.Join(dir, "test-component", ".upload-"+corruptUploadID, "1"), []byte("x"), 0644); err != nil {
+		t.Fatal("error corrupting chunk:", err)
+	}
+
+	// When
+	err = store.CompleteUpload("test-component", "1", uploadID, uploaded)
+	corruptErr := store.CompleteUpload("test-component", "2", corruptUploadID, corruptUploaded)
+
+	// Then
+	if err != nil {
+		t.Fatal("error completing upload:", err)
+	}
+	if release := readRelease(t, store, "test-component", "1"); !bytes.Equal(release, bytes.Join(chunks, nil)) {
+		t.Fatal("release does not match the uploaded chunks")
+	}
+	if corruptErr == nil || !strings.Contains(corruptErr.Error(), "checksum mismatch for chunk 1") {
+		t.Fatal("expected checksum mismatch error, got:", corruptErr)
+	}
+	if exists, err := store.Exists("test-component", "2"); err != nil || exists {
+		t.Fatalf("expected corrupt release not to be stored, exists: %v, error: %v", exists, err)
+	}
+}
@@ -0,0 +1,258 @@
+package common
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	// ZipFormat stores releases as zip files - this is the default.
+	ZipFormat ReleaseFormat = zipFormat{}
+	// TarGzipFormat stores releases as gzip compressed tar files.
+	TarGzipFormat ReleaseFormat = &tarFormat{
+		extension:       "tar.gz",
+		magic:           []byte{0x1f, 0x8b},
+		newCompressor:   func(writer io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(writer), nil },
+		newDecompressor: func(reader io.Reader) (io.ReadCloser, error) { return gzip.NewReader(reader) },
+	}
+	// TarZstdFormat stores releases as zstd compressed tar files.
+	TarZstdFormat ReleaseFormat = &tarFormat{
+		extension:       "tar.zst",
+		magic:           []byte{0x28, 0xb5, 0x2f, 0xfd},
+		newCompressor:   func(writer io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(writer) },
+		newDecompressor: newZstdDecompressor,
+	}
+)
+
+type zipFormat struct{}
+
+func (zipFormat) Extension() string {
+	return "zip"
+}
+
+func (zipFormat) matches(header []byte) bool {
+	return bytes.HasPrefix(header, []byte("PK\x03\x04")) || bytes.HasPrefix(header, []byte("PK\x05\x06"))
+}
+
+func (zipFormat) newWriter(writer io.Writer) (releaseArchiveWriter, error) {
+	return &zipArchiveWriter{zip.NewWriter(writer)}, nil
+}
+
+func (zipFormat) newReader(reader io.Reader) (releaseArchiveReader, error) {
+	// zip needs random access to the central directory at the end of the file
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	zipReader, err := zip.NewReader(bytes.NewReader(contents), int64(len(contents)))
+	if err != nil {
+		return nil, err
+	}
+	return &zipArchiveReader{files: zipReader.File}, nil
+}
+
+type zipArchiveWriter struct {
+	zipWriter *zip.Writer
+}
+
+func (w *zipArchiveWriter) writeDir(name string, info os.FileInfo) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name + "/"
+	_, err = w.zipWriter.CreateHeader(header)
+	return err
+}
+
+func (w *zipArchiveWriter) writeSymlink(name, target string, info os.FileInfo) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	writer, err := w.zipWriter.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write([]byte(target))
+	return err
+}
+
+func (w *zipArchiveWriter) writeFile(name string, info os.FileInfo, reader io.Reader) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	writer, err := w.zipWriter.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, reader)
+	return err
+}
+
+func (w *zipArchiveWriter) Close() error {
+	return w.zipWriter.Close()
+}
+
+type zipArchiveReader struct {
+	files   []*zip.File
+	current io.ReadCloser
+}
+
+func (r *zipArchiveReader) next() (*releaseArchiveEntry, error) {
+	if err := r.closeCurrent(); err != nil {
+		return nil, err
+	}
+	if len(r.files) == 0 {
+		return nil, io.EOF
+	}
+	file := r.files[0]
+	r.files = r.files[1:]
+	reader, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	r.current = reader
+	entry := &releaseArchiveEntry{name: file.Name, info: file.FileInfo(), reader: reader}
+	if file.Mode()&os.ModeSymlink != 0 {
+		if entry.target, err = readSymlinkTarget(reader); err != nil {
+			return nil, err
+		}
+	}
+	return entry, nil
+}
+
+func (r *zipArchiveReader) closeCurrent() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
+
+func (r *zipArchiveReader) Close() error {
+	return r.closeCurrent()
+}
+
+// tarFormat is a tar archive wrapped in a compression stream.
+type tarFormat struct {
+	extension       string
+	magic           []byte
+	newCompressor   func(io.Writer) (io.WriteCloser, error)
+	newDecompressor func(io.Reader) (io.ReadCloser, error)
+}
+
+func (f *tarFormat) Extension() string {
+	return f.extension
+}
+
+func (f *tarFormat) matches(header []byte) bool {
+	return bytes.HasPrefix(header, f.magic)
+}
+
+func (f *tarFormat) newWriter(writer io.Writer) (releaseArchiveWriter, error) {
+	compressor, err := f.newCompressor(writer)
+	if err != nil {
+		return nil, err
+	}
+	return &tarArchiveWriter{compressor: compressor, tarWriter: tar.NewWriter(compressor)}, nil
+}
+
+func (f *tarFormat) newReader(reader io.Reader) (releaseArchiveReader, error) {
+	decompressor, err := f.newDecompressor(reader)
+	if err != nil {
+		return nil, err
+	}
+	return &tarArchiveReader{decompressor: decompressor, tarReader: tar.NewReader(decompressor)}, nil
+}
+
+type tarArchiveWriter struct {
+	compressor io.WriteCloser
+	tarWriter  *tar.Writer
+}
+
+func (w *tarArchiveWriter) writeHeader(name, target string, info os.FileInfo) error {
+	header, err := tar.FileInfoHeader(info, target)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	return w.tarWriter.WriteHeader(header)
+}
+
+func (w *tarArchiveWriter) writeDir(name string, info os.FileInfo) error {
+	return w.writeHeader(name, "", info)
+}
+
+func (w *tarArchiveWriter) writeSymlink(name, target string, info os.FileInfo) error {
+	return w.writeHeader(name, target, info)
+}
+
+func (w *tarArchiveWriter) writeFile(name string, info os.FileInfo, reader io.Reader) error {
+	if err := w.writeHeader(name, "", info); err != nil {
+		return err
+	}
+	_, err := io.Copy(w.tarWriter, reader)
+	return err
+}
+
+func (w *tarArchiveWriter) Close() error {
+	if err := w.tarWriter.Close(); err != nil {
+		return err
+	}
+	return w.compressor.Close()
+}
+
+type tarArchiveReader struct {
+	decompressor io.ReadCloser
+	tarReader    *tar.Reader
+}
+
+func (r *tarArchiveReader) next() (*releaseArchiveEntry, error) {
+	header, err := r.tarReader.Next()
+	if err != nil {
+		return nil, err
+	}
+	return &releaseArchiveEntry{
+		name:   header.Name,
+		info:   header.FileInfo(),
+		target: header.Linkname,
+		reader: r.tarReader,
+	}, nil
+}
+
+func (r *tarArchiveReader) Close() error {
+	return r.decompressor.Close()
+}
+
+// zstdDecompressor adapts zstd.Decoder, whose Close does not return an error, to io.ReadCloser.
+type zstdDecompressor struct {
+	*zstd.Decoder
+}
+
+func (d zstdDecompressor) Close() error {
+	d.Decoder.Close()
+	return nil
+}
+
+func newZstdDecompressor(reader io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	return zstdDecompressor{decoder}, nil
+}
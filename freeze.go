@@ -0,0 +1,141 @@
+package common
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// FreezeOverrideEnvVar is the variable in PrepareTerraformRequest.Env that can hold the emergency override token to
+// deploy during a freeze.
+const FreezeOverrideEnvVar = "CDFLOW2_FREEZE_OVERRIDE"
+
+// Freeze is a period when deploys to some environments (or all environments if Envs is empty) are refused.
+type Freeze struct {
+	Name   string
+	Reason string
+	Envs   []string
+	Start  time.Time
+	End    time.Time
+}
+
+// Applies returns whether the freeze is active for an environment at the given time.
+func (f *Freeze) Applies(env string, now time.Time) bool {
+	if now.Before(f.Start) || !now.Before(f.End) {
+		return false
+	}
+	if len(f.Envs) == 0 {
+		return true
+	}
+	for _, frozenEnv := range f.Envs {
+		if frozenEnv == env {
+			return true
+		}
+	}
+	return false
+}
+
+// FreezeCalendar is a list of freezes.
+type FreezeCalendar struct {
+	Freezes []*Freeze
+}
+
+// ReadFreezeCalendar reads a freeze calendar from JSON, e.g.
+//
+//	{"freezes": [{"name": "black friday", "envs": ["live"], "start": "2020-11-26T00:00:00Z", "end": "2020-11-30T00:00:00Z"}]}
+func ReadFreezeCalendar(reader io.Reader) (*FreezeCalendar, error) {
+	var calendar FreezeCalendar
+	if err := json.NewDecoder(reader).Decode(&calendar); err != nil {
+		return nil, fmt.Errorf("error reading freeze calendar: %s", err)
+	}
+	if err := calendar.validate(); err != nil {
+		return nil, err
+	}
+	return &calendar, nil
+}
+
+// FreezeCalendarFromConfig reads a freeze calendar from the "freezes" key of a request's Config, in the same format
+// as ReadFreezeCalendar. It returns an empty calendar if the key is not set.
+func FreezeCalendarFromConfig(config map[string]interface{}) (*FreezeCalendar, error) {
+	freezes, ok := config["freezes"]
+	if !ok {
+		return &FreezeCalendar{}, nil
+	}
+	data, err := json.Marshal(map[string]interface{}{"freezes": freezes})
+	if err != nil {
+		return nil, fmt.Errorf("error reading freezes from config: %s", err)
+	}
+	return ReadFreezeCalendar(strings.NewReader(string(data)))
+}
+
+func (c *FreezeCalendar) validate() error {
+	for i, freeze := range c.Freezes {
+		if freeze.Name == "" {
+			return fmt.Errorf("freeze %d has no name", i)
+		}
+		if !freeze.End.After(freeze.Start) {
+			return fmt.Errorf("freeze %q must end after it starts", freeze.Name)
+		}
+	}
+	return nil
+}
+
+// Active returns the freezes active for an environment at the given time.
+func (c *FreezeCalendar) Active(env string, now time.Time) []*Freeze {
+	var result []*Freeze
+	for _, freeze := range c.Freezes {
+		if freeze.Applies(env, now) {
+			result = append(result, freeze)
+		}
+	}
+	return result
+}
+
+type freezeGate struct {
+	calendar      *FreezeCalendar
+	overrideToken string
+}
+
+// CreateFreezeGate returns a DeploymentGate that refuses deploys during a freeze, unless FreezeOverrideEnvVar in the
+// request's Env matches the override token. An empty override token means freezes cannot be overridden. If the
+// calendar is nil, it is read from the "freezes" key of each request's Config.
+func CreateFreezeGate(calendar *FreezeCalendar, overrideToken string) DeploymentGate {
+	return &freezeGate{calendar: calendar, overrideToken: overrideToken}
+}
+
+func (g *freezeGate) Check(request *PrepareTerraformRequest) error {
+	calendar := g.calendar
+	if calendar == nil {
+		var err error
+		if calendar, err = FreezeCalendarFromConfig(request.Config); err != nil {
+			return err
+		}
+	}
+	active := calendar.Active(request.EnvName, time.Now())
+	if len(active) == 0 {
+		return nil
+	}
+	if token, ok := request.Env[FreezeOverrideEnvVar]; ok && g.overrideToken != "" {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(g.overrideToken)) == 1 {
+			return nil
+		}
+		return errors.New("invalid freeze override token in " + FreezeOverrideEnvVar)
+	}
+	descriptions := make([]string, 0, len(active))
+	for _, freeze := range active {
+		description := fmt.Sprintf("%q until %s", freeze.Name, freeze.End.UTC().Format(time.RFC3339))
+		if freeze.Reason != "" {
+			description += " (" + freeze.Reason + ")"
+		}
+		descriptions = append(descriptions, description)
+	}
+	message := fmt.Sprintf("deploys to %s are frozen: %s", request.EnvName, strings.Join(descriptions, ", "))
+	if g.overrideToken != "" {
+		message += " - set " + FreezeOverrideEnvVar + " to the emergency override token to deploy anyway"
+	}
+	return errors.New(message)
+}
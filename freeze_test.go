@@ -0,0 +1,74 @@
+package common_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func TestFreezeGate(t *testing.T) {
+	// Given
+	now := time.Now().UTC()
+	end := now.Add(time.Hour).Truncate(time.Second)
+	config := map[string]interface{}{
+		"freezes": []interface{}{
+			map[string]interface{}{
+				"name":   "peak trading",
+				"reason": "black friday",
+				"envs":   []interface{}{"live"},
+				"start":  now.Add(-time.Hour).Format(time.RFC3339),
+				"end":    end.Format(time.RFC3339),
+			},
+			map[string]interface{}{
+				"name":  "past",
+				"start": now.Add(-3 * time.Hour).Format(time.RFC3339),
+				"end":   now.Add(-2 * time.Hour).Format(time.RFC3339),
+			},
+		},
+	}
+	calendar, err := common.FreezeCalendarFromConfig(config)
+	if err != nil {
+		t.Fatal("error reading freeze calendar:", err)
+	}
+	gate := common.CreateFreezeGate(calendar, "let-me-in")
+
+	// When
+	unfrozen := gate.Check(prepareTerraformRequest("test-component", "1", "aslive"))
+	frozen := gate.Check(prepareTerraformRequest("test-component", "1", "live"))
+	badOverride := prepareTerraformRequest("test-component", "1", "live")
+	badOverride.Env[common.FreezeOverrideEnvVar] = "guess"
+	badOverrideErr := gate.Check(badOverride)
+	override := prepareTerraformRequest("test-component", "1", "live")
+	override.Env[common.FreezeOverrideEnvVar] = "let-me-in"
+	overrideErr := gate.Check(override)
+	fromRequest := prepareTerraformRequest("test-component", "1", "live")
+	fromRequest.Config = config
+	fromRequestErr := common.CreateFreezeGate(nil, "").Check(fromRequest)
+
+	// Then
+	if unfrozen != nil {
+		t.Fatal("expected deploy to aslive to be allowed:", unfrozen)
+	}
+	expected := `deploys to live are frozen: "peak trading" until ` + end.Format(time.RFC3339) + " (black friday)"
+	if frozen == nil || !strings.HasPrefix(frozen.Error(), expected) {
+		t.Fatalf("got %v, wanted prefix %q", frozen, expected)
+	}
+	if badOverrideErr == nil {
+		t.Fatal("expected an invalid override token to be refused")
+	}
+	if overrideErr != nil {
+		t.Fatal("expected override token to allow the deploy:", overrideErr)
+	}
+	if fromRequestErr == nil || strings.Contains(fromRequestErr.Error(), common.FreezeOverrideEnvVar) {
+		t.Fatalf("expected freeze from request config without an override, got %v", fromRequestErr)
+	}
+}
+
+func TestReadFreezeCalendarValidates(t *testing.T) {
+	_, err := common.ReadFreezeCalendar(strings.NewReader(`{"freezes": [{"name": "backwards", "start": "2020-02-01T00:00:00Z", "end": "2020-01-01T00:00:00Z"}]}`))
+	if err == nil || !strings.Contains(err.Error(), "must end after it starts") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DeploymentGate decides whether a release may be deployed to an environment.
+type DeploymentGate interface {
+	// Check returns an error explaining why the deployment is refused, or nil if it may go ahead.
+	Check(request *PrepareTerraformRequest) error
+}
+
+type gatedHandler struct {
+	HandlerWrapper
+	gates []DeploymentGate
+}
+
+// CreateGatedHandler wraps a handler so that PrepareTerraform is refused unless every gate allows the deployment.
+// To only record deployments that pass the gates, wrap the result with CreateLedgerHandler.
+func CreateGatedHandler(handler Handler, gates ...DeploymentGate) Handler {
+	return &gatedHandler{HandlerWrapper: HandlerWrapper{handler}, gates: gates}
+}
+
+func (h *gatedHandler) PrepareTerraform(request *PrepareTerraformRequest, response *PrepareTerraformResponse, releaseDir string) error {
+	for _, gate := range h.gates {
+		if err := gate.Check(request); err != nil {
+			return err
+		}
+	}
+	return h.Handler.PrepareTerraform(request, response, releaseDir)
+}
+
+// PromotionRule requires a release to have been deployed successfully to each of the After environments before it is
+// deployed to Env. A deployment only counts once its outcome has been recorded as succeeded in the ledger, since
+// prepare_terraform happens before terraform is applied.
+type PromotionRule struct {
+	Env   string
+	After []string
+}
+
+type promotionGate struct {
+	ledger DeploymentLedger
+	rules  []*PromotionRule
+}
+
+// CreatePromotionGate returns a DeploymentGate that enforces promotion rules using the deployments recorded in a
+// ledger - e.g. that a version is only deployed to live once it has been deployed successfully to aslive.
+func CreatePromotionGate(ledger DeploymentLedger, rules ...*PromotionRule) DeploymentGate {
+	return &promotionGate{ledger: ledger, rules: rules}
+}
+
+func (g *promotionGate) Check(request *PrepareTerraformRequest) error {
+	var missing []string
+	for _, rule := range g.rules {
+		if rule.Env != request.EnvName {
+			continue
+		}
+		for _, env := range rule.After {
+			deployed, err := g.deployedTo(request.Component, request.Version, env)
+			if err != nil {
+				return fmt.Errorf("error checking deployment history: %s", err)
+			}
+			if !deployed {
+				missing = append(missing, env)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf(
+			"%s version %s cannot be deployed to %s until it has been deployed successfully to %s",
+			request.Component, request.Version, request.EnvName, strings.Join(missing, " and "),
+		)
+	}
+	return nil
+}
+
+// deployedTo returns whether the outcome of a deployment of the version to env was recorded as succeeded.
+func (g *promotionGate) deployedTo(component, version, env string) (bool, error) {
+	deployments, err := g.ledger.History(component, env)
+	if err != nil {
+		return false, err
+	}
+	for _, deployment := range deployments {
+		if deployment.Version == version && deployment.Status == DeploymentSucceeded {
+			return true, nil
+		}
+	}
+	return false, nil
+}
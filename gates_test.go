@@ -0,0 +1,54 @@
+package common_test
+
+import (
+	"strings"
+	"testing"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func TestPromotionGate(t *testing.T) {
+	// Given
+	ledger, cleanup := createLedger(t)
+	defer cleanup()
+	inner := &stubHandler{}
+	gate := common.CreatePromotionGate(ledger, &common.PromotionRule{Env: "live", After: []string{"aslive"}})
+	handler := common.CreateLedgerHandler(common.CreateGatedHandler(inner, gate), ledger)
+
+	// When
+	refused := handler.PrepareTerraform(prepareTerraformRequest("test-component", "1", "live"), common.CreatePrepareTerraformResponse(), "")
+	if err := handler.PrepareTerraform(prepareTerraformRequest("test-component", "1", "aslive"), common.CreatePrepareTerraformResponse(), ""); err != nil {
+		t.Fatal("error deploying to aslive:", err)
+	}
+	refusedWhilePrepared := handler.PrepareTerraform(prepareTerraformRequest("test-component", "1", "live"), common.CreatePrepareTerraformResponse(), "")
+	if _, err := common.RecordDeploymentOutcome(ledger, "test-component", "1", "aslive", false); err != nil {
+		t.Fatal("error recording failed deployment:", err)
+	}
+	refusedAfterFailure := handler.PrepareTerraform(prepareTerraformRequest("test-component", "1", "live"), common.CreatePrepareTerraformResponse(), "")
+	if _, err := common.RecordDeploymentOutcome(ledger, "test-component", "1", "aslive", true); err == nil {
+		t.Fatal("expected error recording an outcome for a deployment that already has one")
+	}
+	if err := handler.PrepareTerraform(prepareTerraformRequest("test-component", "1", "aslive"), common.CreatePrepareTerraformResponse(), ""); err != nil {
+		t.Fatal("error redeploying to aslive:", err)
+	}
+	if _, err := common.RecordDeploymentOutcome(ledger, "test-component", "1", "aslive", true); err != nil {
+		t.Fatal("error recording successful deployment:", err)
+	}
+	allowed := handler.PrepareTerraform(prepareTerraformRequest("test-component", "1", "live"), common.CreatePrepareTerraformResponse(), "")
+
+	// Then
+	for _, err := range []error{refused, refusedWhilePrepared, refusedAfterFailure} {
+		if err == nil || !strings.Contains(err.Error(), "test-component version 1 cannot be deployed to live until it has been deployed successfully to aslive") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if allowed != nil {
+		t.Fatal("expected deployment to be allowed after aslive:", allowed)
+	}
+	if inner.prepareTerraformCalls != 3 {
+		t.Fatalf("expected refused deployment not to reach the handler, got %d calls", inner.prepareTerraformCalls)
+	}
+	if history, _ := ledger.History("test-component", "live"); len(history) != 1 {
+		t.Fatalf("expected one recorded deployment to live, got %+v", history)
+	}
+}
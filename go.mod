@@ -2,3 +2,4 @@ module github.com/mergermarket/cdflow2-config-common
 
 go 1.13
 
+require github.com/klauspost/compress v1.11.13
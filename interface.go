@@ -1,6 +1,9 @@
 package common
 
-import "io"
+import (
+	"io"
+	"time"
+)
 
 type Monitoring struct {
 	APIKey string
@@ -96,6 +99,17 @@ type Handler interface {
 	PrepareTerraform(request *PrepareTerraformRequest, response *PrepareTerraformResponse, releaseDir string) error
 }
 
+// ConfiguredReleaseUploader is implemented by handlers that need the configure release response as well as the request
+// when uploading a release, e.g. to store its AdditionalMetadata in release.json. Listen calls UploadConfiguredRelease
+// instead of UploadRelease for handlers that implement it.
+type ConfiguredReleaseUploader interface {
+	UploadConfiguredRelease(
+		request *UploadReleaseRequest, response *UploadReleaseResponse,
+		configureReleaseRequest *ConfigureReleaseRequest, configureReleaseResponse *ConfigureReleaseResponse,
+		releaseDir string,
+	) error
+}
+
 // ReleaseLoader helps load a release from block storage.
 type ReleaseLoader interface {
 	Load(
@@ -103,9 +117,79 @@ type ReleaseLoader interface {
 	) (string, error)
 }
 
+// ReleaseInfoLoader is implemented by ReleaseLoaders that can return all of the release info stored in a release, rather
+// than just the terraform image. The loaders in this package implement it.
+type ReleaseInfoLoader interface {
+	LoadWithInfo(
+		reader io.Reader, component, version, releaseDir string,
+	) (*ReleaseInfo, error)
+}
+
 // ReleaseSaver helps save a release to block storage.
 type ReleaseSaver interface {
 	Save(
 		component, version, terraformImage, releaseDir string,
 	) (io.ReadCloser, error)
 }
+
+// ReleaseInfoSaver is implemented by ReleaseSavers that can store all of the release info in a release, rather than
+// just the component, version and terraform image. The savers in this package implement it.
+type ReleaseInfoSaver interface {
+	SaveWithInfo(
+		releaseInfo *ReleaseInfo, releaseDir string,
+	) (io.ReadCloser, error)
+}
+
+// KeyWrapper wraps and unwraps the data keys used to encrypt releases.
+type KeyWrapper interface {
+	WrapKey(dataKey []byte) ([]byte, error)
+	UnwrapKey(wrappedKey []byte) ([]byte, error)
+}
+
+// ReleaseInfo describes what built a release, and is stored inside the release archive as release.json.
+type ReleaseInfo struct {
+	Component          string
+	Version            string
+	Team               string
+	Commit             string
+	TerraformImage     string
+	ReleaseMetadata    map[string]map[string]string
+	AdditionalMetadata map[string]string
+}
+
+// StoredRelease describes a release held in a ReleaseStore.
+type StoredRelease struct {
+	Component    string
+	Version      string
+	Size         int64
+	LastModified time.Time
+}
+
+// ReleaseStore stores release archives by component and version.
+type ReleaseStore interface {
+	Put(component, version string, release io.Reader) error
+	Get(component, version string) (io.ReadCloser, error)
+	Exists(component, version string) (bool, error)
+	// List returns the releases for a component, or for all components if component is empty, oldest first.
+	List(component string) ([]*StoredRelease, error)
+	Delete(component, version string) error
+}
+
+// UploadedChunk records a chunk of a release accepted by a ChunkedReleaseStore.
+type UploadedChunk struct {
+	Index int
+	// Checksum is the base64 encoded SHA-256 of the chunk.
+	Checksum string
+	// Ref is whatever the store needs to refer to the chunk when completing the upload (e.g. an ETag).
+	Ref string
+}
+
+// ChunkedReleaseStore is a ReleaseStore that can accept a release in chunks, so an interrupted upload can be resumed.
+// PutChunk and CompleteUpload return ErrUploadNotFound if the upload no longer exists.
+type ChunkedReleaseStore interface {
+	ReleaseStore
+	BeginUpload(component, version string) (string, error)
+	PutChunk(component, version, uploadID string, index int, chunk []byte, checksum string) (*UploadedChunk, error)
+	CompleteUpload(component, version, uploadID string, chunks []*UploadedChunk) error
+	AbortUpload(component, version, uploadID string) error
+}
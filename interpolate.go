@@ -0,0 +1,221 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Interpolator replaces references in strings with values from a request:
+//
+//	${component} ${version} ${team} ${commit} ${env_name}   fields of the request
+//	${env.NAME}                                           a variable from Env
+//	${config.some.key}                                    a value from Config, with list indexes as numbers
+//
+// Referenced Config values are themselves interpolated, and reference cycles are reported as errors. Env values come
+// from the environment cdflow2 runs in (often secrets), so they are used as they are, never interpolated. Write $${
+// for a literal ${.
+type Interpolator struct {
+	Values map[string]string
+	Env    map[string]string
+	Config map[string]interface{}
+}
+
+// CreatePrepareTerraformInterpolator returns an Interpolator for the fields of a prepare terraform request.
+func CreatePrepareTerraformInterpolator(request *PrepareTerraformRequest) *Interpolator {
+	return &Interpolator{
+		Values: map[string]string{
+			"component": request.Component,
+			"version":   request.Version,
+			"team":      request.Team,
+			"commit":    request.Commit,
+			"env_name":  request.EnvName,
+		},
+		Env:    request.Env,
+		Config: request.Config,
+	}
+}
+
+// CreateConfigureReleaseInterpolator returns an Interpolator for the fields of a configure release request.
+func CreateConfigureReleaseInterpolator(request *ConfigureReleaseRequest) *Interpolator {
+	return &Interpolator{
+		Values: map[string]string{
+			"component": request.Component,
+			"version":   request.Version,
+			"team":      request.Team,
+			"commit":    request.Commit,
+		},
+		Env:    request.Env,
+		Config: request.Config,
+	}
+}
+
+// Interpolate replaces the references in text.
+func (i *Interpolator) Interpolate(text string) (string, error) {
+	return (&interpolation{Interpolator: i}).interpolate(text)
+}
+
+// InterpolateConfig returns a copy of the Config with references in every string value replaced.
+func (i *Interpolator) InterpolateConfig() (map[string]interface{}, error) {
+	result, err := (&interpolation{Interpolator: i}).interpolateValue("config", MergeConfig(i.Config, nil))
+	if err != nil {
+		return nil, err
+	}
+	return result.(map[string]interface{}), nil
+}
+
+// InterpolateEnv returns a copy of env, such as the Env of a response, with references in the values the handler wrote
+// replaced. ${env.NAME} refers to a variable in env if it is set there, otherwise to one in the Interpolator's Env.
+// Values passed through unchanged from the Interpolator's Env are left as they are, like any other Env value.
+func (i *Interpolator) InterpolateEnv(env map[string]string) (map[string]string, error) {
+	written := make(map[string]string, len(env))
+	for name, value := range env {
+		if requestValue, ok := i.Env[name]; !ok || requestValue != value {
+			written[name] = value
+		}
+	}
+	resolving := &interpolation{Interpolator: i, written: written}
+	result := make(map[string]string, len(env))
+	for _, name := range sortedStringKeys(env) {
+		if _, ok := written[name]; !ok {
+			result[name] = env[name]
+			continue
+		}
+		value, err := resolving.resolve("env." + name)
+		if err != nil {
+			return nil, err
+		}
+		result[name] = value
+	}
+	return result, nil
+}
+
+// interpolation tracks the references being resolved, to detect cycles.
+type interpolation struct {
+	*Interpolator
+	// written holds the Env values written by the handler, which are interpolated, unlike those in Interpolator.Env.
+	written map[string]string
+	stack   []string
+}
+
+func (p *interpolation) interpolate(text string) (string, error) {
+	var result strings.Builder
+	for {
+		start := strings.Index(text, "${")
+		if start == -1 {
+			result.WriteString(text)
+			return result.String(), nil
+		}
+		if start > 0 && text[start-1] == '$' {
+			result.WriteString(text[:start-1])
+			result.WriteString("${")
+			text = text[start+2:]
+			continue
+		}
+		end := strings.Index(text[start:], "}")
+		if end == -1 {
+			return "", fmt.Errorf("unterminated reference in %q", text)
+		}
+		value, err := p.resolve(strings.TrimSpace(text[start+2 : start+end]))
+		if err != nil {
+			return "", err
+		}
+		result.WriteString(text[:start])
+		result.WriteString(value)
+		text = text[start+end+1:]
+	}
+}
+
+func (p *interpolation) resolve(reference string) (string, error) {
+	for i, resolving := range p.stack {
+		if resolving == reference {
+			return "", fmt.Errorf("reference cycle: %s -> %s", strings.Join(p.stack[i:], " -> "), reference)
+		}
+	}
+	p.stack = append(p.stack, reference)
+	defer func() { p.stack = p.stack[:len(p.stack)-1] }()
+
+	switch {
+	case strings.HasPrefix(reference, "env."):
+		name := strings.TrimPrefix(reference, "env.")
+		if value, ok := p.written[name]; ok {
+			return p.interpolate(value)
+		}
+		value, ok := p.Env[name]
+		if !ok {
+			return "", fmt.Errorf("unknown reference ${%s}: env variable not set", reference)
+		}
+		return value, nil
+	case strings.HasPrefix(reference, "config."):
+		value, err := lookupConfigPath(p.Config, strings.Split(strings.TrimPrefix(reference, "config."), "."))
+		if err != nil {
+			return "", fmt.Errorf("unknown reference ${%s}: %s", reference, err)
+		}
+		switch value := value.(type) {
+		case string:
+			return p.interpolate(value)
+		case bool:
+			return strconv.FormatBool(value), nil
+		case float64:
+			return strconv.FormatFloat(value, 'f', -1, 64), nil
+		case int:
+			return strconv.Itoa(value), nil
+		}
+		return "", fmt.Errorf("reference ${%s} is %s, not a string", reference, describeConfigValue(value))
+	}
+	if value, ok := p.Values[reference]; ok {
+		return value, nil
+	}
+	return "", fmt.Errorf("unknown reference ${%s}", reference)
+}
+
+func lookupConfigPath(config map[string]interface{}, path []string) (interface{}, error) {
+	var value interface{} = config
+	for i, part := range path {
+		switch current := value.(type) {
+		case map[string]interface{}:
+			next, ok := current[part]
+			if !ok {
+				return nil, fmt.Errorf("%s is not set", strings.Join(path[:i+1], "."))
+			}
+			value = next
+		case []interface{}:
+			index, err := strconv.Atoi(part)
+			if err != nil || index < 0 || index >= len(current) {
+				return nil, fmt.Errorf("%s is not an index in a list of %d items", strings.Join(path[:i+1], "."), len(current))
+			}
+			value = current[index]
+		default:
+			return nil, fmt.Errorf("%s is not a map or list", strings.Join(path[:i], "."))
+		}
+	}
+	return value, nil
+}
+
+func (p *interpolation) interpolateValue(path string, value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case string:
+		result, err := p.interpolate(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		return result, nil
+	case map[string]interface{}:
+		for _, key := range sortedStringKeys(value) {
+			result, err := p.interpolateValue(path+"."+key, value[key])
+			if err != nil {
+				return nil, err
+			}
+			value[key] = result
+		}
+	case []interface{}:
+		for i, item := range value {
+			result, err := p.interpolateValue(fmt.Sprintf("%s[%d]", path, i), item)
+			if err != nil {
+				return nil, err
+			}
+			value[i] = result
+		}
+	}
+	return value, nil
+}
@@ -0,0 +1,101 @@
+package common_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func testInterpolator(t *testing.T) *common.Interpolator {
+	request := prepareTerraformRequest("test-component", "1", "live")
+	request.Env["ACCOUNT"] = "123"
+	request.Env["DB_PASSWORD"] = "p${ss}w0rd$${"
+	request.Config = decodeJSONConfig(t, `{
+		"domain": "example.com",
+		"host": "${component}.${config.domain}",
+		"ports": [80, 443],
+		"bucket": "${team}-${component}-${env_name}",
+		"a": "${config.b}",
+		"b": "${config.a}"
+	}`)
+	return common.CreatePrepareTerraformInterpolator(request)
+}
+
+func TestInterpolate(t *testing.T) {
+	interpolator := testInterpolator(t)
+	for text, expected := range map[string]string{
+		"plain":                             "plain",
+		"${component}-${version}@${commit}": "test-component-1@test-commit",
+		"https://${config.host}:${config.ports.1}": "https://test-component.example.com:443",
+		"arn:aws:iam::${env.ACCOUNT}:root":         "arn:aws:iam::123:root",
+		"postgres://app:${env.DB_PASSWORD}@db":     "postgres://app:p${ss}w0rd$${@db",
+		"$${literal} ${ team }":                    "${literal} test-team",
+	} {
+		result, err := interpolator.Interpolate(text)
+		if err != nil {
+			t.Fatalf("error interpolating %q: %s", text, err)
+		}
+		if result != expected {
+			t.Errorf("interpolating %q, got %q, wanted %q", text, result, expected)
+		}
+	}
+}
+
+func TestInterpolateErrors(t *testing.T) {
+	interpolator := testInterpolator(t)
+	for text, expected := range map[string]string{
+		"${config.a}":       "reference cycle: config.a -> config.b -> config.a",
+		"${config.missing}": "unknown reference ${config.missing}: missing is not set",
+		"${env.MISSING}":    "unknown reference ${env.MISSING}: env variable not set",
+		"${config.ports}":   "reference ${config.ports} is a list, not a string",
+		"${nope}":           "unknown reference ${nope}",
+		"${component":       `unterminated reference in "${component"`,
+	} {
+		_, err := interpolator.Interpolate(text)
+		if err == nil || err.Error() != expected {
+			t.Errorf("interpolating %q, got error %v, wanted %q", text, err, expected)
+		}
+	}
+}
+
+func TestInterpolateEnv(t *testing.T) {
+	// Given
+	interpolator := testInterpolator(t)
+	delete(interpolator.Config, "a")
+	delete(interpolator.Config, "b")
+
+	// When
+	config, err := interpolator.InterpolateConfig()
+	if err != nil {
+		t.Fatal("error interpolating config:", err)
+	}
+	env, err := interpolator.InterpolateEnv(map[string]string{
+		"BUCKET":      "${config.bucket}",
+		"URL":         "s3://${env.BUCKET}/${env.ACCOUNT}",
+		"DB_PASSWORD": "p${ss}w0rd$${",
+		"DB_URL":      "postgres://app:${env.DB_PASSWORD}@db",
+	})
+	if err != nil {
+		t.Fatal("error interpolating env:", err)
+	}
+	_, cycleErr := interpolator.InterpolateEnv(map[string]string{"A": "${env.A}"})
+
+	// Then
+	if config["host"] != "test-component.example.com" || interpolator.Config["host"] != "${component}.${config.domain}" {
+		t.Fatalf("unexpected config: %v", config)
+	}
+	expected := map[string]string{
+		"BUCKET":      "test-team-test-component-live",
+		"URL":         "s3://test-team-test-component-live/123",
+		"DB_PASSWORD": "p${ss}w0rd$${",
+		"DB_URL":      "postgres://app:p${ss}w0rd$${@db",
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Fatalf("got %v, wanted %v", env, expected)
+	}
+	if cycleErr == nil || !strings.Contains(cycleErr.Error(), "env.A -> env.A") {
+		t.Fatalf("unexpected error: %v", cycleErr)
+	}
+}
@@ -0,0 +1,288 @@
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deployment statuses. prepare_terraform happens before terraform runs, so a deployment is recorded as prepared, and
+// the outcome is recorded separately once terraform has been applied (see RecordDeploymentOutcome).
+const (
+	DeploymentPrepared  = "prepared"
+	DeploymentSucceeded = "succeeded"
+	DeploymentFailed    = "failed"
+)
+
+// Deployment records a release being prepared for deployment to an environment, or the outcome of the deployment.
+type Deployment struct {
+	Component      string
+	Version        string
+	Env            string
+	Team           string
+	Commit         string
+	TerraformImage string
+	// Status is DeploymentPrepared, DeploymentSucceeded or DeploymentFailed - entries without a status were prepared.
+	Status string `json:",omitempty"`
+	Time   time.Time
+}
+
+// DeploymentLedger records deployments, so it can say which version of a component is in each environment.
+type DeploymentLedger interface {
+	Record(deployment *Deployment) error
+	// Current returns the most recent deployment of a component to an environment, or nil if there has been none.
+	Current(component, env string) (*Deployment, error)
+	// History returns the deployments of a component, or of all components if component is empty, optionally only
+	// to one environment, oldest first.
+	History(component, env string) ([]*Deployment, error)
+}
+
+type fileDeploymentLedger struct {
+	path  string
+	mutex sync.Mutex
+}
+
+// CreateFileDeploymentLedger returns a DeploymentLedger that appends deployments to a local file as JSON lines. Each
+// deployment is appended with a single write, so several processes can record to the same file.
+func CreateFileDeploymentLedger(path string) DeploymentLedger {
+	return &fileDeploymentLedger{path: path}
+}
+
+func (l *fileDeploymentLedger) Record(deployment *Deployment) error {
+	if err := ValidateReleaseKey(deployment.Component, deployment.Version); err != nil {
+		return err
+	}
+	if deployment.Env == "" {
+		return fmt.Errorf("deployment of %s version %s has no env", deployment.Component, deployment.Version)
+	}
+	data, err := json.Marshal(deployment)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (l *fileDeploymentLedger) Current(component, env string) (*Deployment, error) {
+	deployments, err := l.History(component, env)
+	if err != nil || len(deployments) == 0 {
+		return nil, err
+	}
+	return deployments[len(deployments)-1], nil
+}
+
+func (l *fileDeploymentLedger) History(component, env string) ([]*Deployment, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	file, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var result []*Deployment
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var deployment Deployment
+		if err := json.Unmarshal(scanner.Bytes(), &deployment); err != nil {
+			return nil, fmt.Errorf("error reading deployment ledger %s line %d: %s", l.path, line, err)
+		}
+		if (component == "" || deployment.Component == component) && (env == "" || deployment.Env == env) {
+			result = append(result, &deployment)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Time.Before(result[j].Time)
+	})
+	return result, nil
+}
+
+type ledgerDeploymentHistory struct {
+	ledger DeploymentLedger
+}
+
+// CreateLedgerDeploymentHistory returns a DeploymentHistory for a RetentionPolicy backed by a DeploymentLedger.
+func CreateLedgerDeploymentHistory(ledger DeploymentLedger) DeploymentHistory {
+	return &ledgerDeploymentHistory{ledger: ledger}
+}
+
+func (h *ledgerDeploymentHistory) LastDeployed(component, version string) (time.Time, error) {
+	deployments, err := h.ledger.History(component, "")
+	if err != nil {
+		return time.Time{}, err
+	}
+	var result time.Time
+	for _, deployment := range deployments {
+		if deployment.Version == version && deployment.Time.After(result) {
+			result = deployment.Time
+		}
+	}
+	return result, nil
+}
+
+// CurrentReleases returns the release currently in each environment according to the ledger, as PinnedReleases for a
+// RetentionPolicy.
+func CurrentReleases(ledger DeploymentLedger) ([]*PinnedRelease, error) {
+	deployments, err := ledger.History("", "")
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]*PinnedRelease)
+	for _, deployment := range deployments {
+		current[deployment.Component+"/"+deployment.Env] = &PinnedRelease{
+			Env: deployment.Env, Component: deployment.Component, Version: deployment.Version,
+		}
+	}
+	result := make([]*PinnedRelease, 0, len(current))
+	for _, key := range sortedStringKeys(current) {
+		result = append(result, current[key])
+	}
+	return result, nil
+}
+
+type ledgerHandler struct {
+	HandlerWrapper
+	ledger DeploymentLedger
+}
+
+// CreateLedgerHandler wraps a handler, recording a prepared deployment in the ledger each time its PrepareTerraform
+// succeeds for an environment. This records that terraform was prepared, not that it was applied successfully - record
+// the outcome with RecordDeploymentOutcome (or the deployments command) once terraform has run.
+func CreateLedgerHandler(handler Handler, ledger DeploymentLedger) Handler {
+	return &ledgerHandler{HandlerWrapper: HandlerWrapper{handler}, ledger: ledger}
+}
+
+func (h *ledgerHandler) PrepareTerraform(request *PrepareTerraformRequest, response *PrepareTerraformResponse, releaseDir string) error {
+	if err := h.Handler.PrepareTerraform(request, response, releaseDir); err != nil {
+		return err
+	}
+	if request.EnvName == "" || !response.Success {
+		return nil
+	}
+	if err := h.ledger.Record(&Deployment{
+		Component:      request.Component,
+		Version:        request.Version,
+		Env:            request.EnvName,
+		Team:           request.Team,
+		Commit:         request.Commit,
+		TerraformImage: response.TerraformImage,
+		Status:         DeploymentPrepared,
+		Time:           time.Now().UTC(),
+	}); err != nil {
+		return fmt.Errorf("error recording deployment: %s", err)
+	}
+	return nil
+}
+
+// RecordDeploymentOutcome records whether terraform was applied successfully for the most recent deployment of a
+// version of a component to an environment, which must not already have an outcome.
+func RecordDeploymentOutcome(ledger DeploymentLedger, component, version, env string, succeeded bool) (*Deployment, error) {
+	deployments, err := ledger.History(component, env)
+	if err != nil {
+		return nil, err
+	}
+	var prepared *Deployment
+	for _, deployment := range deployments {
+		if deployment.Version == version {
+			prepared = deployment
+		}
+	}
+	if prepared == nil {
+		return nil, fmt.Errorf("%s version %s has not been prepared for deployment to %s", component, version, env)
+	}
+	if prepared.Status != "" && prepared.Status != DeploymentPrepared {
+		return nil, fmt.Errorf(
+			"the outcome of the last deployment of %s version %s to %s has already been recorded as %s",
+			component, version, env, prepared.Status,
+		)
+	}
+	outcome := *prepared
+	outcome.Status = DeploymentFailed
+	if succeeded {
+		outcome.Status = DeploymentSucceeded
+	}
+	outcome.Time = time.Now().UTC()
+	if err := ledger.Record(&outcome); err != nil {
+		return nil, err
+	}
+	return &outcome, nil
+}
+
+// Deployments implements a deployments command for a config container's main package, with succeeded and failed
+// subcommands to record the outcome of a deployment after terraform has run, and list to show the history.
+func Deployments(ledger DeploymentLedger, args []string, output io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: deployments succeeded|failed|list [options]")
+	}
+	flags := flag.NewFlagSet("deployments "+args[0], flag.ContinueOnError)
+	flags.SetOutput(output)
+	component := flags.String("component", "", "component of the release")
+	version := flags.String("version", "", "version of the release")
+	env := flags.String("env", "", "environment the release was deployed to")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+
+	switch args[0] {
+	case "succeeded", "failed":
+		deployment, err := RecordDeploymentOutcome(ledger, *component, *version, *env, args[0] == "succeeded")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(output, "recorded deployment of %s version %s to %s as %s\n", deployment.Component, deployment.Version, deployment.Env, deployment.Status)
+	case "list":
+		deployments, err := ledger.History(*component, *env)
+		if err != nil {
+			return err
+		}
+		for _, deployment := range deployments {
+			if *version != "" && deployment.Version != *version {
+				continue
+			}
+			status := deployment.Status
+			if status == "" {
+				status = DeploymentPrepared
+			}
+			fmt.Fprintf(
+				output, "%s\t%s\t%s\t%s\t%s\n",
+				deployment.Component, deployment.Version, deployment.Env, status, deployment.Time.Format(time.RFC3339),
+			)
+		}
+	default:
+		return fmt.Errorf("unknown deployments command %q, expected succeeded, failed or list", args[0])
+	}
+	return nil
+}
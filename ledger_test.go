@@ -0,0 +1,140 @@
+package common_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+// stubHandler implements Handler, counting calls to PrepareTerraform and setting the terraform image.
+type stubHandler struct {
+	prepareTerraformCalls int
+}
+
+func (*stubHandler) Setup(*common.SetupRequest, *common.SetupResponse) error {
+	return nil
+}
+
+func (*stubHandler) ConfigureRelease(*common.ConfigureReleaseRequest, *common.ConfigureReleaseResponse) error {
+	return nil
+}
+
+func (*stubHandler) UploadRelease(*common.UploadReleaseRequest, *common.UploadReleaseResponse, *common.ConfigureReleaseRequest, string) error {
+	return nil
+}
+
+func (h *stubHandler) PrepareTerraform(request *common.PrepareTerraformRequest, response *common.PrepareTerraformResponse, releaseDir string) error {
+	h.prepareTerraformCalls++
+	response.TerraformImage = "test-terraform-image:" + request.Version
+	response.TerraformBackendType = "local"
+	return nil
+}
+
+func prepareTerraformRequest(component, version, env string) *common.PrepareTerraformRequest {
+	request := common.CreatePrepareTerraformRequest()
+	request.Component = component
+	request.Version = version
+	request.EnvName = env
+	request.Team = "test-team"
+	request.Commit = "test-commit"
+	return request
+}
+
+func createLedger(t *testing.T) (common.DeploymentLedger, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "cdflow2-config-common-test-ledger")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	return common.CreateFileDeploymentLedger(filepath.Join(dir, "ledger", "deployments.jsonl")), func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLedgerHandlerRecordsDeployments(t *testing.T) {
+	// Given
+	ledger, cleanup := createLedger(t)
+	defer cleanup()
+	handler := common.CreateLedgerHandler(&stubHandler{}, ledger)
+	before := time.Now().Add(-time.Second)
+
+	// When
+	for _, deploy := range [][2]string{{"1", "aslive"}, {"1", "live"}, {"2", "aslive"}} {
+		request := prepareTerraformRequest("test-component", deploy[0], deploy[1])
+		if err := handler.PrepareTerraform(request, common.CreatePrepareTerraformResponse(), ""); err != nil {
+			t.Fatal("error in PrepareTerraform:", err)
+		}
+	}
+
+	// Then
+	current, err := ledger.Current("test-component", "aslive")
+	if err != nil {
+		t.Fatal("error getting current deployment:", err)
+	}
+	if current.Version != "2" || current.Team != "test-team" || current.Commit != "test-commit" ||
+		current.TerraformImage != "test-terraform-image:2" || current.Time.Before(before) {
+		t.Fatalf("unexpected current deployment: %+v", current)
+	}
+	if current, err := ledger.Current("test-component", "dev"); err != nil || current != nil {
+		t.Fatalf("expected no deployment to dev, got %+v, error: %v", current, err)
+	}
+	history, err := ledger.History("test-component", "")
+	if err != nil {
+		t.Fatal("error getting history:", err)
+	}
+	if len(history) != 3 || history[0].Env != "aslive" || history[1].Env != "live" || history[2].Version != "2" {
+		t.Fatalf("unexpected history: %+v", history)
+	}
+	pinned, err := common.CurrentReleases(ledger)
+	if err != nil {
+		t.Fatal("error getting current releases:", err)
+	}
+	if len(pinned) != 2 || pinned[0].Env != "aslive" || pinned[0].Version != "2" || pinned[1].Env != "live" || pinned[1].Version != "1" {
+		t.Fatalf("unexpected current releases: %+v %+v", pinned[0], pinned[1])
+	}
+	deployed, err := common.CreateLedgerDeploymentHistory(ledger).LastDeployed("test-component", "1")
+	if err != nil || deployed != history[1].Time {
+		t.Fatalf("got %v, wanted %v (error: %v)", deployed, history[1].Time, err)
+	}
+}
+
+func TestDeploymentsCommand(t *testing.T) {
+	// Given
+	ledger, cleanup := createLedger(t)
+	defer cleanup()
+	handler := common.CreateLedgerHandler(&stubHandler{}, ledger)
+	if err := handler.PrepareTerraform(prepareTerraformRequest("test-component", "1", "aslive"), common.CreatePrepareTerraformResponse(), ""); err != nil {
+		t.Fatal("error in PrepareTerraform:", err)
+	}
+	var output bytes.Buffer
+
+	// When
+	if err := common.Deployments(ledger, []string{"succeeded", "-component", "test-component", "-version", "1", "-env", "aslive"}, &output); err != nil {
+		t.Fatal("error recording outcome:", err)
+	}
+	if err := common.Deployments(ledger, []string{"list", "-component", "test-component"}, &output); err != nil {
+		t.Fatal("error listing deployments:", err)
+	}
+	notPrepared := common.Deployments(ledger, []string{"failed", "-component", "test-component", "-version", "2", "-env", "aslive"}, &output)
+
+	// Then
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 3 || lines[0] != "recorded deployment of test-component version 1 to aslive as succeeded" ||
+		!strings.HasPrefix(lines[1], "test-component\t1\taslive\tprepared\t") ||
+		!strings.HasPrefix(lines[2], "test-component\t1\taslive\tsucceeded\t") {
+		t.Fatalf("unexpected output: %q", output.String())
+	}
+	if notPrepared == nil || !strings.Contains(notPrepared.Error(), "has not been prepared") {
+		t.Fatalf("unexpected error: %v", notPrepared)
+	}
+	current, err := ledger.Current("test-component", "aslive")
+	if err != nil || current.Status != common.DeploymentSucceeded || current.TerraformImage != "test-terraform-image:1" {
+		t.Fatalf("unexpected current deployment: %+v (error: %v)", current, err)
+	}
+}
@@ -0,0 +1,109 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NeedResult is what a NeedProvider contributes to a configure release response.
+type NeedResult struct {
+	// Env is added to the env of the build with the need.
+	Env map[string]string
+	// AdditionalMetadata is added to the release metadata.
+	AdditionalMetadata map[string]string
+}
+
+// NeedProvider provides for a need of a build in ReleaseRequirements, e.g. "lambda" or "ecr".
+type NeedProvider interface {
+	ConfigureRelease(buildID string, request *ConfigureReleaseRequest) (*NeedResult, error)
+}
+
+// NeedProviderFunc adapts a function to a NeedProvider.
+type NeedProviderFunc func(buildID string, request *ConfigureReleaseRequest) (*NeedResult, error)
+
+// ConfigureRelease calls the function.
+func (f NeedProviderFunc) ConfigureRelease(buildID string, request *ConfigureReleaseRequest) (*NeedResult, error) {
+	return f(buildID, request)
+}
+
+// NeedRegistry holds NeedProviders by the name of the need they provide for.
+type NeedRegistry struct {
+	providers map[string]NeedProvider
+}
+
+// CreateNeedRegistry returns an empty NeedRegistry.
+func CreateNeedRegistry() *NeedRegistry {
+	return &NeedRegistry{providers: make(map[string]NeedProvider)}
+}
+
+// Register adds the provider for a need, replacing any existing provider for it.
+func (r *NeedRegistry) Register(need string, provider NeedProvider) {
+	r.providers[need] = provider
+}
+
+// Supported returns the needs with a provider, in order.
+func (r *NeedRegistry) Supported() []string {
+	return sortedStringKeys(r.providers)
+}
+
+// ConfigureRelease calls the provider for each need of each build in the request's ReleaseRequirements, adding the
+// env vars to the build's env and the metadata to the response. Unknown needs are reported together, with the needs
+// that are supported.
+func (r *NeedRegistry) ConfigureRelease(request *ConfigureReleaseRequest, response *ConfigureReleaseResponse) error {
+	var unknown []string
+	for _, buildID := range sortedStringKeys(request.ReleaseRequirements) {
+		requirements := request.ReleaseRequirements[buildID]
+		if requirements == nil {
+			continue
+		}
+		for _, need := range requirements.Needs {
+			if _, ok := r.providers[need]; !ok {
+				unknown = append(unknown, fmt.Sprintf("%q (build %s)", need, buildID))
+			}
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf(
+			"unsupported release needs: %s - supported needs are: %s",
+			strings.Join(unknown, ", "), strings.Join(r.Supported(), ", "),
+		)
+	}
+
+	for _, buildID := range sortedStringKeys(request.ReleaseRequirements) {
+		requirements := request.ReleaseRequirements[buildID]
+		if requirements == nil {
+			continue
+		}
+		for _, need := range requirements.Needs {
+			result, err := r.providers[need].ConfigureRelease(buildID, request)
+			if err != nil {
+				return fmt.Errorf("error providing %s for build %s: %s", need, buildID, err)
+			}
+			if result == nil {
+				continue
+			}
+			if len(result.Env) > 0 && response.Env == nil {
+				response.Env = make(map[string]map[string]string)
+			}
+			if len(result.AdditionalMetadata) > 0 && response.AdditionalMetadata == nil {
+				response.AdditionalMetadata = make(map[string]string)
+			}
+			if len(result.Env) > 0 && response.Env[buildID] == nil {
+				response.Env[buildID] = make(map[string]string)
+			}
+			for name, value := range result.Env {
+				if existing, ok := response.Env[buildID][name]; ok && existing != value {
+					return fmt.Errorf("need %s for build %s sets %s, which is already set to a different value", need, buildID, name)
+				}
+				response.Env[buildID][name] = value
+			}
+			for key, value := range result.AdditionalMetadata {
+				if existing, ok := response.AdditionalMetadata[key]; ok && existing != value {
+					return fmt.Errorf("need %s for build %s sets metadata %s, which is already set to a different value", need, buildID, key)
+				}
+				response.AdditionalMetadata[key] = value
+			}
+		}
+	}
+	return nil
+}
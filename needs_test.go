@@ -0,0 +1,59 @@
+package common_test
+
+import (
+	"reflect"
+	"testing"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func testNeedRegistry() *common.NeedRegistry {
+	registry := common.CreateNeedRegistry()
+	registry.Register("lambda", common.NeedProviderFunc(func(buildID string, request *common.ConfigureReleaseRequest) (*common.NeedResult, error) {
+		return &common.NeedResult{
+			Env:                map[string]string{"LAMBDA_BUCKET": request.Team + "-lambdas"},
+			AdditionalMetadata: map[string]string{"lambda_build": buildID},
+		}, nil
+	}))
+	registry.Register("ecr", common.NeedProviderFunc(func(buildID string, request *common.ConfigureReleaseRequest) (*common.NeedResult, error) {
+		return &common.NeedResult{Env: map[string]string{"ECR_REPOSITORY": request.Component}}, nil
+	}))
+	return registry
+}
+
+func TestNeedRegistry(t *testing.T) {
+	// Given
+	request := common.CreateConfigureReleaseRequest()
+	request.Team = "test-team"
+	request.Component = "test-component"
+	request.ReleaseRequirements["app"] = &common.ReleaseRequirements{Needs: []string{"lambda", "ecr"}}
+	request.ReleaseRequirements["docs"] = &common.ReleaseRequirements{}
+	response := common.CreateConfigureReleaseResponse()
+
+	// When
+	if err := testNeedRegistry().ConfigureRelease(request, response); err != nil {
+		t.Fatal("error configuring release:", err)
+	}
+
+	// Then
+	expectedEnv := map[string]map[string]string{
+		"app": {"LAMBDA_BUCKET": "test-team-lambdas", "ECR_REPOSITORY": "test-component"},
+	}
+	if !reflect.DeepEqual(response.Env, expectedEnv) {
+		t.Fatalf("got %v, wanted %v", response.Env, expectedEnv)
+	}
+	if response.AdditionalMetadata["lambda_build"] != "app" {
+		t.Fatalf("unexpected metadata: %v", response.AdditionalMetadata)
+	}
+}
+
+func TestNeedRegistryUnknownNeeds(t *testing.T) {
+	request := common.CreateConfigureReleaseRequest()
+	request.ReleaseRequirements["app"] = &common.ReleaseRequirements{Needs: []string{"lambda", "s3-bucket"}}
+	request.ReleaseRequirements["site"] = &common.ReleaseRequirements{Needs: []string{"cdn"}}
+	err := testNeedRegistry().ConfigureRelease(request, common.CreateConfigureReleaseResponse())
+	expected := `unsupported release needs: "s3-bucket" (build app), "cdn" (build site) - supported needs are: ecr, lambda`
+	if err == nil || err.Error() != expected {
+		t.Fatalf("got %v, wanted %q", err, expected)
+	}
+}
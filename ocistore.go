@@ -0,0 +1,571 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ReleaseArtifactType is the OCI artifact type of releases pushed by the OCI release store.
+	ReleaseArtifactType = "application/vnd.cdflow2.release.v1"
+	// ReleaseConfigMediaType is the media type of the config blob, which holds the release info.
+	ReleaseConfigMediaType = "application/vnd.cdflow2.release.config.v1+json"
+	// ReleaseLayerMediaType is the media type of the layer holding the release archive.
+	ReleaseLayerMediaType = "application/vnd.cdflow2.release.layer.v1"
+	// TerraformImageAnnotation is the manifest annotation recording the terraform image for the release.
+	TerraformImageAnnotation = "com.mergermarket.cdflow2.terraform-image"
+
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociCreatedAnnotation = "org.opencontainers.image.created"
+	ociVersionAnnotation = "org.opencontainers.image.version"
+	ociTitleAnnotation   = "org.opencontainers.image.title"
+)
+
+var ociTagPattern = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+
+// OCIReleaseStoreConfig configures a ReleaseStore backed by an OCI distribution registry.
+type OCIReleaseStoreConfig struct {
+	// Registry is the base URL of the registry, e.g. https://registry.example.com.
+	Registry string
+	// Repository is the prefix for repositories - releases are pushed to {Repository}/{component}:{version}.
+	Repository string
+	// Username and Password are used for basic auth, or to get a bearer token when the registry asks for one.
+	Username   string
+	Password   string
+	HTTPClient *http.Client
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type ociReleaseStore struct {
+	config        OCIReleaseStoreConfig
+	registryHost  string
+	client        *http.Client
+	mutex         sync.Mutex
+	authorization map[string]string
+}
+
+// CreateOCIReleaseStore returns a ReleaseStore that pushes releases to an OCI registry as artifacts.
+func CreateOCIReleaseStore(config *OCIReleaseStoreConfig) (ReleaseStore, error) {
+	if config.Registry == "" {
+		return nil, errors.New("oci release store registry must be set")
+	}
+	if config.Repository == "" {
+		return nil, errors.New("oci release store repository must be set")
+	}
+	result := &ociReleaseStore{
+		config:        *config,
+		client:        config.HTTPClient,
+		authorization: make(map[string]string),
+	}
+	result.config.Registry = strings.TrimSuffix(result.config.Registry, "/")
+	registryURL, err := url.Parse(result.config.Registry)
+	if err != nil || registryURL.Host == "" {
+		return nil, fmt.Errorf("invalid oci release store registry %q", config.Registry)
+	}
+	result.registryHost = registryURL.Host
+	result.config.Repository = strings.Trim(result.config.Repository, "/")
+	if result.client == nil {
+		result.client = http.DefaultClient
+	}
+	return result, nil
+}
+
+func (s *ociReleaseStore) repository(component string) string {
+	return s.config.Repository + "/" + component
+}
+
+func validateOCIReleaseKey(component, version string) error {
+	if err := ValidateReleaseKey(component, version); err != nil {
+		return err
+	}
+	if !ociTagPattern.MatchString(version) {
+		return fmt.Errorf("release version %q is not a valid OCI tag", version)
+	}
+	return nil
+}
+
+// Put pushes the release as the single layer of an artifact, tagged with the version. The release info is read
+// from the archive and stored as the config blob, with the terraform image also recorded as an annotation.
+func (s *ociReleaseStore) Put(component, version string, release io.Reader) error {
+	if err := validateOCIReleaseKey(component, version); err != nil {
+		return err
+	}
+	repository := s.repository(component)
+
+	file, err := ioutil.TempFile("", "cdflow2-config-common-oci-release")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hasher), release)
+	if err != nil {
+		return err
+	}
+	layer := ociDescriptor{
+		MediaType:   ReleaseLayerMediaType,
+		Digest:      fmt.Sprintf("sha256:%x", hasher.Sum(nil)),
+		Size:        size,
+		Annotations: map[string]string{ociTitleAnnotation: component + "-" + version},
+	}
+
+	annotations := map[string]string{
+		ociCreatedAnnotation: time.Now().UTC().Format(time.RFC3339),
+		ociVersionAnnotation: version,
+	}
+	configData := []byte("{}")
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if releaseInfo, err := ReadReleaseInfo(file); err == nil {
+		annotations[TerraformImageAnnotation] = releaseInfo.TerraformImage
+		if configData, err = json.Marshal(releaseInfo); err != nil {
+			return err
+		}
+	}
+	config := ociDescriptor{
+		MediaType: ReleaseConfigMediaType,
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(configData)),
+		Size:      int64(len(configData)),
+	}
+
+	if err := s.pushBlob(repository, config, strings.NewReader(string(configData))); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := s.pushBlob(repository, layer, file); err != nil {
+		return err
+	}
+
+	manifest, err := json.Marshal(&ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		ArtifactType:  ReleaseArtifactType,
+		Config:        config,
+		Layers:        []ociDescriptor{layer},
+		Annotations:   annotations,
+	})
+	if err != nil {
+		return err
+	}
+	response, err := s.do(http.MethodPut, repository, "/v2/"+repository+"/manifests/"+version, strings.NewReader(string(manifest)), int64(len(manifest)), "Content-Type", ociManifestMediaType)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return checkOCIStatus(response, http.StatusCreated)
+}
+
+// pushBlob uploads a blob unless the registry already has it.
+func (s *ociReleaseStore) pushBlob(repository string, descriptor ociDescriptor, content io.ReadSeeker) error {
+	response, err := s.do(http.MethodHead, repository, "/v2/"+repository+"/blobs/"+descriptor.Digest, nil, 0)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	response, err = s.do(http.MethodPost, repository, "/v2/"+repository+"/blobs/uploads/", nil, 0)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if err := checkOCIStatus(response, http.StatusAccepted); err != nil {
+		return err
+	}
+	location, err := response.Request.URL.Parse(response.Header.Get("Location"))
+	if err != nil {
+		return fmt.Errorf("invalid blob upload location: %s", err)
+	}
+	query := location.Query()
+	query.Set("digest", descriptor.Digest)
+	location.RawQuery = query.Encode()
+
+	response, err = s.do(http.MethodPut, repository, location.String(), content, descriptor.Size, "Content-Type", "application/octet-stream")
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return checkOCIStatus(response, http.StatusCreated)
+}
+
+func (s *ociReleaseStore) getManifest(component, version string) (*ociManifest, error) {
+	repository := s.repository(component)
+	response, err := s.do(http.MethodGet, repository, "/v2/"+repository+"/manifests/"+version, nil, 0, "Accept", ociManifestMediaType)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return nil, ErrReleaseNotFound
+	}
+	if err := checkOCIStatus(response, http.StatusOK); err != nil {
+		return nil, err
+	}
+	var manifest ociManifest
+	if err := json.NewDecoder(response.Body).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("error decoding manifest for %s:%s: %s", repository, version, err)
+	}
+	return &manifest, nil
+}
+
+func releaseLayer(manifest *ociManifest) (*ociDescriptor, error) {
+	for _, layer := range manifest.Layers {
+		if layer.MediaType == ReleaseLayerMediaType {
+			return &layer, nil
+		}
+	}
+	return nil, fmt.Errorf("manifest has no layer with media type %s", ReleaseLayerMediaType)
+}
+
+// Get pulls the release layer, verifying its digest as it is read.
+func (s *ociReleaseStore) Get(component, version string) (io.ReadCloser, error) {
+	if err := validateOCIReleaseKey(component, version); err != nil {
+		return nil, err
+	}
+	manifest, err := s.getManifest(component, version)
+	if err != nil {
+		return nil, err
+	}
+	layer, err := releaseLayer(manifest)
+	if err != nil {
+		return nil, err
+	}
+	repository := s.repository(component)
+	response, err := s.do(http.MethodGet, repository, "/v2/"+repository+"/blobs/"+layer.Digest, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkOCIStatus(response, http.StatusOK); err != nil {
+		response.Body.Close()
+		return nil, err
+	}
+	return &digestVerifyingReader{body: response.Body, hash: sha256.New(), expected: layer.Digest}, nil
+}
+
+type digestVerifyingReader struct {
+	body     io.ReadCloser
+	hash     hash.Hash
+	expected string
+}
+
+func (r *digestVerifyingReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF {
+		if got := fmt.Sprintf("sha256:%x", r.hash.Sum(nil)); got != r.expected {
+			return n, fmt.Errorf("release digest mismatch, expected %s, got %s", r.expected, got)
+		}
+	}
+	return n, err
+}
+
+func (r *digestVerifyingReader) Close() error {
+	return r.body.Close()
+}
+
+func (s *ociReleaseStore) Exists(component, version string) (bool, error) {
+	if err := validateOCIReleaseKey(component, version); err != nil {
+		return false, err
+	}
+	repository := s.repository(component)
+	response, err := s.do(http.MethodHead, repository, "/v2/"+repository+"/manifests/"+version, nil, 0, "Accept", ociManifestMediaType)
+	if err != nil {
+		return false, err
+	}
+	response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	return true, checkOCIStatus(response, http.StatusOK)
+}
+
+// List returns the tagged releases, using the created annotation of each manifest for the last modified time.
+func (s *ociReleaseStore) List(component string) ([]*StoredRelease, error) {
+	components := []string{component}
+	if component == "" {
+		var err error
+		if components, err = s.listComponents(); err != nil {
+			return nil, err
+		}
+	} else if err := validateReleaseKeyPart("component", component); err != nil {
+		return nil, err
+	}
+	var result []*StoredRelease
+	for _, component := range components {
+		repository := s.repository(component)
+		var tags []string
+		if err := s.paginate(repository, "/v2/"+repository+"/tags/list", func(body io.Reader) error {
+			var page struct {
+				Tags []string `json:"tags"`
+			}
+			if err := json.NewDecoder(body).Decode(&page); err != nil {
+				return err
+			}
+			tags = append(tags, page.Tags...)
+			return nil
+		}); err != nil {
+			if err == ErrReleaseNotFound {
+				continue
+			}
+			return nil, err
+		}
+		for _, tag := range tags {
+			manifest, err := s.getManifest(component, tag)
+			if err != nil {
+				return nil, err
+			}
+			if manifest.ArtifactType != ReleaseArtifactType {
+				continue
+			}
+			stored := &StoredRelease{Component: component, Version: tag}
+			if layer, err := releaseLayer(manifest); err == nil {
+				stored.Size = layer.Size
+			}
+			stored.LastModified, _ = time.Parse(time.RFC3339, manifest.Annotations[ociCreatedAnnotation])
+			result = append(result, stored)
+		}
+	}
+	sortStoredReleases(result)
+	return result, nil
+}
+
+func (s *ociReleaseStore) listComponents() ([]string, error) {
+	var components []string
+	prefix := s.config.Repository + "/"
+	err := s.paginate("", "/v2/_catalog", func(body io.Reader) error {
+		var page struct {
+			Repositories []string `json:"repositories"`
+		}
+		if err := json.NewDecoder(body).Decode(&page); err != nil {
+			return err
+		}
+		for _, repository := range page.Repositories {
+			if strings.HasPrefix(repository, prefix) && !strings.Contains(repository[len(prefix):], "/") {
+				components = append(components, repository[len(prefix):])
+			}
+		}
+		return nil
+	})
+	return components, err
+}
+
+var ociNextLinkPattern = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// paginate calls handlePage for each page of a list endpoint, following Link headers.
+func (s *ociReleaseStore) paginate(repository, path string, handlePage func(io.Reader) error) error {
+	for path != "" {
+		response, err := s.do(http.MethodGet, repository, path, nil, 0)
+		if err != nil {
+			return err
+		}
+		if response.StatusCode == http.StatusNotFound {
+			response.Body.Close()
+			return ErrReleaseNotFound
+		}
+		if err := checkOCIStatus(response, http.StatusOK); err != nil {
+			response.Body.Close()
+			return err
+		}
+		err = handlePage(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return err
+		}
+		path = ""
+		if match := ociNextLinkPattern.FindStringSubmatch(response.Header.Get("Link")); match != nil {
+			next, err := response.Request.URL.Parse(match[1])
+			if err != nil {
+				return err
+			}
+			path = next.String()
+		}
+	}
+	return nil
+}
+
+// Delete removes the manifest for the release by digest, as registries do not allow deleting by tag.
+func (s *ociReleaseStore) Delete(component, version string) error {
+	if err := validateOCIReleaseKey(component, version); err != nil {
+		return err
+	}
+	repository := s.repository(component)
+	response, err := s.do(http.MethodHead, repository, "/v2/"+repository+"/manifests/"+version, nil, 0, "Accept", ociManifestMediaType)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return ErrReleaseNotFound
+	}
+	if err := checkOCIStatus(response, http.StatusOK); err != nil {
+		return err
+	}
+	digest := response.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return fmt.Errorf("registry did not return a digest for %s:%s", repository, version)
+	}
+	response, err = s.do(http.MethodDelete, repository, "/v2/"+repository+"/manifests/"+digest, nil, 0)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return checkOCIStatus(response, http.StatusAccepted)
+}
+
+func checkOCIStatus(response *http.Response, expectedStatus int) error {
+	if response.StatusCode == expectedStatus || (expectedStatus != http.StatusOK && response.StatusCode == http.StatusOK) {
+		return nil
+	}
+	return fmt.Errorf("registry %s %s failed with status %d", response.Request.Method, response.Request.URL.Path, response.StatusCode)
+}
+
+// do sends a request to the registry, authenticating and retrying once if the registry asks for credentials.
+// Extra headers are passed as name, value pairs. Credentials are only sent to the registry host, not to other hosts
+// the registry points to, e.g. a storage backend in a blob upload location.
+func (s *ociReleaseStore) do(method, repository, path string, body io.ReadSeeker, size int64, headers ...string) (*http.Response, error) {
+	requestURL := path
+	if strings.HasPrefix(path, "/") {
+		requestURL = s.config.Registry + path
+	}
+	for attempt := 0; ; attempt++ {
+		var requestBody io.Reader
+		if body != nil {
+			if _, err := body.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			requestBody = ioutil.NopCloser(body)
+		}
+		request, err := http.NewRequest(method, requestURL, requestBody)
+		if err != nil {
+			return nil, err
+		}
+		request.ContentLength = size
+		for i := 0; i+1 < len(headers); i += 2 {
+			request.Header.Set(headers[i], headers[i+1])
+		}
+		registryHost := request.URL.Host == s.registryHost
+		s.mutex.Lock()
+		authorization := s.authorization[repository]
+		s.mutex.Unlock()
+		if authorization != "" && registryHost {
+			request.Header.Set("Authorization", authorization)
+		}
+		response, err := s.client.Do(request)
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode != http.StatusUnauthorized || attempt > 0 || !registryHost {
+			return response, nil
+		}
+		response.Body.Close()
+		if err := s.authenticate(repository, response.Header.Get("WWW-Authenticate")); err != nil {
+			return nil, err
+		}
+	}
+}
+
+var ociChallengeParamPattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// authenticate responds to a WWW-Authenticate challenge with basic auth or by fetching a bearer token.
+func (s *ociReleaseStore) authenticate(repository, challenge string) error {
+	var authorization string
+	switch {
+	case strings.HasPrefix(strings.ToLower(challenge), "basic"):
+		authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(s.config.Username+":"+s.config.Password))
+	case strings.HasPrefix(strings.ToLower(challenge), "bearer"):
+		params := make(map[string]string)
+		for _, match := range ociChallengeParamPattern.FindAllStringSubmatch(challenge, -1) {
+			params[match[1]] = match[2]
+		}
+		token, err := s.fetchToken(repository, params)
+		if err != nil {
+			return err
+		}
+		authorization = "Bearer " + token
+	default:
+		return fmt.Errorf("unsupported registry authentication challenge %q", challenge)
+	}
+	s.mutex.Lock()
+	s.authorization[repository] = authorization
+	s.mutex.Unlock()
+	return nil
+}
+
+func (s *ociReleaseStore) fetchToken(repository string, params map[string]string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid registry token realm %q", params["realm"])
+	}
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	scope := params["scope"]
+	if scope == "" && repository != "" {
+		scope = "repository:" + repository + ":pull,push,delete"
+	}
+	if scope != "" {
+		query.Set("scope", scope)
+	}
+	realm.RawQuery = query.Encode()
+	request, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if s.config.Username != "" {
+		request.SetBasicAuth(s.config.Username, s.config.Password)
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry token request failed with status %d", response.StatusCode)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("error decoding registry token: %s", err)
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	return token.AccessToken, nil
+}
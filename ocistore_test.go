@@ -0,0 +1,264 @@
+package common_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+// fakeRegistry is a minimal stand-in for an OCI distribution registry that requires bearer token auth.
+type fakeRegistry struct {
+	mutex     sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string]map[string][]byte // repository -> tag or digest -> manifest
+	uploads   int
+	// uploadURL, if set, is where blob uploads are sent instead of the registry, e.g. a storage backend.
+	uploadURL string
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		blobs:     make(map[string][]byte),
+		manifests: make(map[string]map[string][]byte),
+	}
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if r.URL.Path == "/token" {
+		if username, password, ok := r.BasicAuth(); !ok || username != "test-user" || password != "test-password" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": "test-token"})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="test-registry"`, r.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	body, _ := ioutil.ReadAll(r.Body)
+	switch {
+	case path == "_catalog":
+		var repositories []string
+		for repository := range f.manifests {
+			repositories = append(repositories, repository)
+		}
+		sort.Strings(repositories)
+		json.NewEncoder(w).Encode(map[string][]string{"repositories": repositories})
+	case strings.HasSuffix(path, "/tags/list"):
+		manifests, ok := f.manifests[strings.TrimSuffix(path, "/tags/list")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var tags []string
+		for reference := range manifests {
+			if !strings.HasPrefix(reference, "sha256:") {
+				tags = append(tags, reference)
+			}
+		}
+		sort.Strings(tags)
+		json.NewEncoder(w).Encode(map[string][]string{"tags": tags})
+	case strings.Contains(path, "/blobs/uploads/") && r.Method == http.MethodPost:
+		f.uploads++
+		w.Header().Set("Location", fmt.Sprintf("%s/v2/%supload-%d?state=abc", f.uploadURL, path, f.uploads))
+		w.WriteHeader(http.StatusAccepted)
+	case strings.Contains(path, "/blobs/uploads/") && r.Method == http.MethodPut:
+		digest := r.URL.Query().Get("digest")
+		if r.URL.Query().Get("state") != "abc" || digest != fmt.Sprintf("sha256:%x", sha256.Sum256(body)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.blobs[digest] = body
+		w.WriteHeader(http.StatusCreated)
+	case strings.Contains(path, "/blobs/"):
+		blob, ok := f.blobs[path[strings.LastIndex(path, "/")+1:]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(blob)
+	case strings.Contains(path, "/manifests/"):
+		parts := strings.SplitN(path, "/manifests/", 2)
+		repository, reference := parts[0], parts[1]
+		f.manifest(w, r, repository, reference, body)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeRegistry) manifest(w http.ResponseWriter, r *http.Request, repository, reference string, body []byte) {
+	switch r.Method {
+	case http.MethodPut:
+		if r.Header.Get("Content-Type") != "application/vnd.oci.image.manifest.v1+json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if f.manifests[repository] == nil {
+			f.manifests[repository] = make(map[string][]byte)
+		}
+		f.manifests[repository][reference] = body
+		f.manifests[repository][fmt.Sprintf("sha256:%x", sha256.Sum256(body))] = body
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet, http.MethodHead:
+		manifest, ok := f.manifests[repository][reference]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sha256.Sum256(manifest)))
+		w.Write(manifest)
+	case http.MethodDelete:
+		manifest, ok := f.manifests[repository][reference]
+		if !ok || !strings.HasPrefix(reference, "sha256:") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for ref, other := range f.manifests[repository] {
+			if bytes.Equal(other, manifest) {
+				delete(f.manifests[repository], ref)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func createOCIReleaseStore(t *testing.T, server *httptest.Server) common.ReleaseStore {
+	t.Helper()
+	store, err := common.CreateOCIReleaseStore(&common.OCIReleaseStoreConfig{
+		Registry:   server.URL,
+		Repository: "test-team/releases",
+		Username:   "test-user",
+		Password:   "test-password",
+	})
+	if err != nil {
+		t.Fatal("error creating oci release store:", err)
+	}
+	return store
+}
+
+func TestOCIReleaseStore(t *testing.T) {
+	server := httptest.NewServer(newFakeRegistry())
+	defer server.Close()
+
+	testReleaseStore(t, createOCIReleaseStore(t, server))
+}
+
+func TestOCIReleaseStoreOnlySendsCredentialsToRegistry(t *testing.T) {
+	// Given
+	registry := newFakeRegistry()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	var uploadAuthorization []string
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uploadAuthorization = append(uploadAuthorization, r.Header.Get("Authorization"))
+		// the storage backend authorises uploads through the signed location, not registry credentials
+		r.Header.Set("Authorization", "Bearer test-token")
+		registry.ServeHTTP(w, r)
+	}))
+	defer storage.Close()
+	registry.uploadURL = storage.URL
+	store := createOCIReleaseStore(t, server)
+
+	// When
+	if err := store.Put("test-component", "1", strings.NewReader("test-release")); err != nil {
+		t.Fatal("error putting release:", err)
+	}
+
+	// Then
+	if len(uploadAuthorization) == 0 {
+		t.Fatal("expected blob uploads to go to the storage backend")
+	}
+	for _, authorization := range uploadAuthorization {
+		if authorization != "" {
+			t.Fatalf("registry credentials sent to storage backend: %q", authorization)
+		}
+	}
+}
+
+func TestOCIReleaseStoreRecordsReleaseInfo(t *testing.T) {
+	// Given
+	registry := newFakeRegistry()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	store := createOCIReleaseStore(t, server)
+	var release bytes.Buffer
+	if err := common.ZipRelease(&release, releaseDir(t), "test-component", "1", "test-terraform-image"); err != nil {
+		t.Fatal("error zipping release:", err)
+	}
+
+	// When
+	if err := store.Put("test-component", "1", bytes.NewReader(release.Bytes())); err != nil {
+		t.Fatal("error putting release:", err)
+	}
+
+	// Then
+	var manifest struct {
+		ArtifactType string
+		Config       struct{ MediaType, Digest string }
+		Layers       []struct{ MediaType string }
+		Annotations  map[string]string
+	}
+	if err := json.Unmarshal(registry.manifests["test-team/releases/test-component"]["1"], &manifest); err != nil {
+		t.Fatal("error decoding manifest:", err)
+	}
+	if manifest.ArtifactType != common.ReleaseArtifactType {
+		t.Fatalf("got artifact type %q, wanted %q", manifest.ArtifactType, common.ReleaseArtifactType)
+	}
+	if len(manifest.Layers) != 1 || manifest.Layers[0].MediaType != common.ReleaseLayerMediaType {
+		t.Fatalf("unexpected layers: %+v", manifest.Layers)
+	}
+	if got := manifest.Annotations[common.TerraformImageAnnotation]; got != "test-terraform-image" {
+		t.Fatalf("got terraform image annotation %q, wanted %q", got, "test-terraform-image")
+	}
+	var releaseInfo common.ReleaseInfo
+	if err := json.Unmarshal(registry.blobs[manifest.Config.Digest], &releaseInfo); err != nil {
+		t.Fatal("error decoding config blob:", err)
+	}
+	if releaseInfo.Component != "test-component" || releaseInfo.TerraformImage != "test-terraform-image" {
+		t.Fatalf("unexpected release info in config: %+v", releaseInfo)
+	}
+}
+
+func TestOCIReleaseStoreDetectsCorruptTarLayer(t *testing.T) {
+	for _, format := range []common.ReleaseFormat{common.TarGzipFormat, common.TarZstdFormat} {
+		t.Run(format.Extension(), func(t *testing.T) {
+			// Given
+			registry := newFakeRegistry()
+			server := httptest.NewServer(registry)
+			defer server.Close()
+			store := createOCIReleaseStore(t, server)
+			release := savedRelease(t, format)
+			if err := store.Put("test-component", "1", bytes.NewReader(release)); err != nil {
+				t.Fatal("error putting release:", err)
+			}
+			// past the end of the tar archive, so only the digest can catch it
+			digest := fmt.Sprintf("sha256:%x", sha256.Sum256(release))
+			registry.blobs[digest] = append(release, "corrupt"...)
+
+			// When
+			err := loadRelease(t, store, "test-component", "1")
+
+			// Then
+			if err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+				t.Fatal("expected digest mismatch error, got:", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package common
+
+import "fmt"
+
+// EnvironmentsConfigKey is the Config key holding per-environment overrides for ResolveEnvConfig.
+const EnvironmentsConfigKey = "environments"
+
+// ResolveEnvConfig returns the config for an environment: the base keys of config with the section for the
+// environment under EnvironmentsConfigKey deep merged over them (see MergeConfig), e.g.
+//
+//	instances: 1
+//	environments:
+//	  live:
+//	    instances: 3
+//
+// resolves to instances: 3 for live and instances: 1 everywhere else. The environments key is not included in the
+// result, and config is not modified.
+func ResolveEnvConfig(config map[string]interface{}, env string) (map[string]interface{}, error) {
+	base := make(map[string]interface{}, len(config))
+	for key, value := range config {
+		if key != EnvironmentsConfigKey {
+			base[key] = value
+		}
+	}
+	environments, ok := config[EnvironmentsConfigKey]
+	if !ok || environments == nil {
+		return MergeConfig(base, nil), nil
+	}
+	environmentsMap, ok := environments.(map[string]interface{})
+	if !ok {
+		return nil, &ConfigError{Key: "config." + EnvironmentsConfigKey, Message: "must be a map of environment names to config"}
+	}
+	overlay, ok := environmentsMap[env]
+	if !ok || overlay == nil {
+		return MergeConfig(base, nil), nil
+	}
+	overlayMap, ok := overlay.(map[string]interface{})
+	if !ok {
+		return nil, &ConfigError{
+			Key:     fmt.Sprintf("config.%s.%s", EnvironmentsConfigKey, env),
+			Message: fmt.Sprintf("must be a map, got %s", describeConfigValue(overlay)),
+		}
+	}
+	return MergeConfig(base, overlayMap), nil
+}
+
+// MergeConfig returns a deep merge of overlay over base. Maps are merged recursively, any other value in overlay
+// (including a list) replaces the value in base, and a null in overlay deletes the key. Neither argument is modified.
+func MergeConfig(base, overlay map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(base))
+	for key, value := range base {
+		result[key] = copyConfigValue(value)
+	}
+	for key, value := range overlay {
+		if value == nil {
+			delete(result, key)
+			continue
+		}
+		overlayMap, overlayIsMap := value.(map[string]interface{})
+		baseMap, _ := result[key].(map[string]interface{})
+		if overlayIsMap {
+			// a map replacing a value that is not a map is merged over nothing, so its nulls are dropped too
+			result[key] = MergeConfig(baseMap, overlayMap)
+		} else {
+			result[key] = copyConfigValue(value)
+		}
+	}
+	return result
+}
+
+func copyConfigValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return MergeConfig(value, nil)
+	case []interface{}:
+		result := make([]interface{}, len(value))
+		for i, item := range value {
+			result[i] = copyConfigValue(item)
+		}
+		return result
+	}
+	return value
+}
@@ -0,0 +1,68 @@
+package common_test
+
+import (
+	"reflect"
+	"testing"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func TestResolveEnvConfig(t *testing.T) {
+	// Given
+	config := decodeJSONConfig(t, `{
+		"instances": 1,
+		"debug": true,
+		"dns": {"zone": "example.com", "ttl": 60},
+		"subnets": ["a", "b"],
+		"environments": {
+			"live": {
+				"instances": 3,
+				"debug": null,
+				"dns": {"ttl": 300},
+				"subnets": ["c"],
+				"alerts": {"channel": "#ops", "pager": null}
+			}
+		}
+	}`)
+
+	// When
+	live, err := common.ResolveEnvConfig(config, "live")
+	if err != nil {
+		t.Fatal("error resolving config:", err)
+	}
+	dev, err := common.ResolveEnvConfig(config, "dev")
+	if err != nil {
+		t.Fatal("error resolving config:", err)
+	}
+
+	// Then
+	expectedLive := decodeJSONConfig(t, `{
+		"instances": 3,
+		"dns": {"zone": "example.com", "ttl": 300},
+		"subnets": ["c"],
+		"alerts": {"channel": "#ops"}
+	}`)
+	if !reflect.DeepEqual(live, expectedLive) {
+		t.Fatalf("got %v, wanted %v", live, expectedLive)
+	}
+	expectedDev := decodeJSONConfig(t, `{
+		"instances": 1,
+		"debug": true,
+		"dns": {"zone": "example.com", "ttl": 60},
+		"subnets": ["a", "b"]
+	}`)
+	if !reflect.DeepEqual(dev, expectedDev) {
+		t.Fatalf("got %v, wanted %v", dev, expectedDev)
+	}
+	if config["dns"].(map[string]interface{})["ttl"] != float64(60) {
+		t.Fatal("config was modified")
+	}
+}
+
+func TestResolveEnvConfigInvalidOverlay(t *testing.T) {
+	config := decodeJSONConfig(t, `{"environments": {"live": "big"}}`)
+	_, err := common.ResolveEnvConfig(config, "live")
+	if err == nil || err.Error() != `config.environments.live: must be a map, got "big"` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package common
+
+import (
+	"errors"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces sensitive values in redacted text.
+const Redacted = "[REDACTED]"
+
+// minSecretLength is the length below which values are not redacted, since short values such as "1" or "yes" would
+// redact unrelated text.
+const minSecretLength = 4
+
+var sensitiveKeyPattern = regexp.MustCompile(`(?i)(^|_)(SECRET|TOKEN|PASSWORD)(_|$)`)
+
+// IsSensitiveKey returns whether an env var name looks like it holds a secret, e.g. DB_PASSWORD, GITHUB_TOKEN or
+// AWS_SECRET_ACCESS_KEY.
+func IsSensitiveKey(name string) bool {
+	return sensitiveKeyPattern.MatchString(name)
+}
+
+// Redactor tracks sensitive values and removes them from text.
+type Redactor struct {
+	mutex  sync.Mutex
+	values []string
+}
+
+// CreateRedactor returns a Redactor with no sensitive values.
+func CreateRedactor() *Redactor {
+	return &Redactor{}
+}
+
+// AddSecret marks a value as sensitive.
+func (r *Redactor) AddSecret(value string) {
+	if len(value) < minSecretLength {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, existing := range r.values {
+		if existing == value {
+			return
+		}
+	}
+	r.values = append(r.values, value)
+	// replace longer values first, so a secret containing another is redacted completely
+	sort.SliceStable(r.values, func(i, j int) bool {
+		return len(r.values[i]) > len(r.values[j])
+	})
+}
+
+// TrackEnv marks the values of sensitive keys in an env map as sensitive.
+func (r *Redactor) TrackEnv(env map[string]string) {
+	for name, value := range env {
+		if IsSensitiveKey(name) {
+			r.AddSecret(value)
+		}
+	}
+}
+
+// TrackBackendConfigParameters marks backend config parameters with a DisplayValue as sensitive.
+func (r *Redactor) TrackBackendConfigParameters(parameters map[string]*TerraformBackendConfigParameter) {
+	for _, parameter := range parameters {
+		if parameter != nil && parameter.DisplayValue != "" && parameter.DisplayValue != parameter.Value {
+			r.AddSecret(parameter.Value)
+		}
+	}
+}
+
+// Redact returns text with every sensitive value replaced.
+func (r *Redactor) Redact(text string) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, value := range r.values {
+		text = strings.Replace(text, value, Redacted, -1)
+	}
+	return text
+}
+
+// RedactError returns an error with the sensitive values in its message replaced, or nil if err is nil.
+func (r *Redactor) RedactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	message := r.Redact(err.Error())
+	if message == err.Error() {
+		return err
+	}
+	return errors.New(message)
+}
+
+type redactingWriter struct {
+	redactor *Redactor
+	writer   io.Writer
+}
+
+// Writer returns a writer that redacts what is written before passing it on, e.g. for the log package's output or a
+// recording of a session. Each write is redacted separately, so a value split across writes is not redacted.
+func (r *Redactor) Writer(writer io.Writer) io.Writer {
+	return &redactingWriter{redactor: r, writer: writer}
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.writer, w.redactor.Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
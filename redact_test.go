@@ -0,0 +1,56 @@
+package common_test
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func TestIsSensitiveKey(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"DB_PASSWORD":           true,
+		"GITHUB_TOKEN":          true,
+		"AWS_SECRET_ACCESS_KEY": true,
+		"client_secret":         true,
+		"TOKENISER_URL":         false,
+		"SECRETARY":             false,
+		"AWS_REGION":            false,
+	} {
+		if common.IsSensitiveKey(name) != expected {
+			t.Errorf("IsSensitiveKey(%q) should be %v", name, expected)
+		}
+	}
+}
+
+func TestRedactor(t *testing.T) {
+	// Given
+	redactor := common.CreateRedactor()
+	redactor.TrackEnv(map[string]string{"DB_PASSWORD": "hunter22", "AWS_REGION": "eu-west-1", "API_TOKEN": "abc"})
+	redactor.AddSecret("s3cr3t")
+	redactor.AddSecret("s3cr3t-longer")
+	redactor.TrackBackendConfigParameters(map[string]*common.TerraformBackendConfigParameter{
+		"access_key": {Value: "AKIAEXAMPLE", DisplayValue: "AKIA***"},
+		"bucket":     {Value: "state-bucket"},
+	})
+	var output bytes.Buffer
+	logger := log.New(redactor.Writer(&output), "", 0)
+
+	// When
+	logger.Println("connecting with hunter22 in eu-west-1 using s3cr3t-longer and AKIAEXAMPLE to state-bucket, abc")
+	err := redactor.RedactError(errors.New("login failed for s3cr3t"))
+
+	// Then
+	expected := "connecting with [REDACTED] in eu-west-1 using [REDACTED] and [REDACTED] to state-bucket, abc\n"
+	if output.String() != expected {
+		t.Fatalf("got %q, wanted %q", output.String(), expected)
+	}
+	if err.Error() != "login failed for [REDACTED]" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if redactor.RedactError(nil) != nil {
+		t.Fatal("expected nil error to stay nil")
+	}
+}
@@ -0,0 +1,93 @@
+package common
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var envVarNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ResponseError is every problem found validating a response before it is sent.
+type ResponseError struct {
+	Response string
+	Problems []string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Response, strings.Join(e.Problems, "; "))
+}
+
+// ValidateConfigureReleaseResponse checks that the Env in a configure release response only names builds declared in
+// the request's ReleaseRequirements, and only sets valid environment variable names.
+func ValidateConfigureReleaseResponse(response *ConfigureReleaseResponse, request *ConfigureReleaseRequest) error {
+	var problems []string
+	for _, buildID := range sortedStringKeys(response.Env) {
+		if _, ok := request.ReleaseRequirements[buildID]; !ok {
+			problems = append(problems, fmt.Sprintf(
+				"Env is set for build %q, which is not in ReleaseRequirements (builds: %s)",
+				buildID, strings.Join(sortedStringKeys(request.ReleaseRequirements), ", "),
+			))
+		}
+		problems = append(problems, checkEnvVarNames(fmt.Sprintf("Env[%q]", buildID), response.Env[buildID])...)
+	}
+	if len(problems) > 0 {
+		return &ResponseError{Response: "ConfigureReleaseResponse", Problems: problems}
+	}
+	return nil
+}
+
+// ValidatePrepareTerraformResponse checks that a successful prepare terraform response has a terraform image and
+// backend type, that no backend config key is also a backend config parameter, and that Env only sets valid
+// environment variable names.
+func ValidatePrepareTerraformResponse(response *PrepareTerraformResponse) error {
+	var problems []string
+	if response.Success {
+		if response.TerraformImage == "" {
+			problems = append(problems, "TerraformImage must be set")
+		}
+		if response.TerraformBackendType == "" {
+			problems = append(problems, "TerraformBackendType must be set")
+		}
+	}
+	for _, key := range sortedStringKeys(response.TerraformBackendConfig) {
+		if _, ok := response.TerraformBackendConfigParameters[key]; ok {
+			problems = append(problems, fmt.Sprintf(
+				"backend config %q is set in both TerraformBackendConfig and TerraformBackendConfigParameters", key,
+			))
+		}
+	}
+	for _, key := range sortedStringKeys(response.TerraformBackendConfigParameters) {
+		if response.TerraformBackendConfigParameters[key] == nil {
+			problems = append(problems, fmt.Sprintf("TerraformBackendConfigParameters[%q] is null", key))
+		}
+	}
+	problems = append(problems, checkEnvVarNames("Env", response.Env)...)
+	if len(problems) > 0 {
+		return &ResponseError{Response: "PrepareTerraformResponse", Problems: problems}
+	}
+	return nil
+}
+
+func checkEnvVarNames(field string, env map[string]string) []string {
+	var problems []string
+	for _, name := range sortedStringKeys(env) {
+		if !envVarNamePattern.MatchString(name) {
+			problems = append(problems, fmt.Sprintf("%s has invalid environment variable name %q", field, name))
+		}
+	}
+	return problems
+}
+
+// sortedStringKeys returns the keys of a map with string keys in order.
+func sortedStringKeys(m interface{}) []string {
+	values := reflect.ValueOf(m).MapKeys()
+	keys := make([]string, len(values))
+	for i, value := range values {
+		keys[i] = value.String()
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,54 @@
+package common_test
+
+import (
+	"testing"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func TestValidatePrepareTerraformResponse(t *testing.T) {
+	// Given
+	response := common.CreatePrepareTerraformResponse()
+	response.Env["GOOD_NAME"] = "value"
+	response.Env["bad-name"] = "value"
+	response.TerraformBackendConfig["bucket"] = "state"
+	response.TerraformBackendConfigParameters["bucket"] = &common.TerraformBackendConfigParameter{Value: "state"}
+
+	// When
+	err := common.ValidatePrepareTerraformResponse(response)
+
+	// Then
+	expected := "invalid PrepareTerraformResponse: TerraformImage must be set; TerraformBackendType must be set; " +
+		`backend config "bucket" is set in both TerraformBackendConfig and TerraformBackendConfigParameters; ` +
+		`Env has invalid environment variable name "bad-name"`
+	if err == nil || err.Error() != expected {
+		t.Fatalf("got %v, wanted %q", err, expected)
+	}
+
+	response.Success = false
+	delete(response.Env, "bad-name")
+	delete(response.TerraformBackendConfig, "bucket")
+	if err := common.ValidatePrepareTerraformResponse(response); err != nil {
+		t.Fatal("expected unsuccessful response without an image to be valid:", err)
+	}
+}
+
+func TestValidateConfigureReleaseResponse(t *testing.T) {
+	// Given
+	request := common.CreateConfigureReleaseRequest()
+	request.ReleaseRequirements["app"] = &common.ReleaseRequirements{}
+	request.ReleaseRequirements["infra"] = &common.ReleaseRequirements{}
+	response := common.CreateConfigureReleaseResponse()
+	response.Env["app"] = map[string]string{"1BAD": "value"}
+	response.Env["ap"] = map[string]string{"FOO": "value"}
+
+	// When
+	err := common.ValidateConfigureReleaseResponse(response, request)
+
+	// Then
+	expected := `invalid ConfigureReleaseResponse: Env is set for build "ap", which is not in ReleaseRequirements (builds: app, infra); ` +
+		`Env["app"] has invalid environment variable name "1BAD"`
+	if err == nil || err.Error() != expected {
+		t.Fatalf("got %v, wanted %q", err, expected)
+	}
+}
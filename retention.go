@@ -0,0 +1,155 @@
+package common
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// DeploymentHistory tells a RetentionPolicy when releases were last deployed.
+type DeploymentHistory interface {
+	// LastDeployed returns when a release was last deployed to any environment, or the zero time if it never was.
+	LastDeployed(component, version string) (time.Time, error)
+}
+
+// PinnedRelease is a release that an environment depends on, and so must never be deleted.
+type PinnedRelease struct {
+	Env       string
+	Component string
+	Version   string
+}
+
+// RetentionPolicy decides which releases in a ReleaseStore are still needed. A release is kept if any rule keeps it.
+type RetentionPolicy struct {
+	// KeepLast is the number of most recent versions to keep for each component.
+	KeepLast int
+	// KeepDeployedWithin keeps any release deployed within this long, according to History.
+	KeepDeployedWithin time.Duration
+	History            DeploymentHistory
+	Pinned             []*PinnedRelease
+}
+
+// RetentionDecision is the outcome of applying a RetentionPolicy to a release.
+type RetentionDecision struct {
+	Release *StoredRelease
+	Keep    bool
+	// Reasons explains why the release is kept, and is empty if it is not.
+	Reasons []string
+}
+
+// Evaluate decides which of the releases to keep, returning a decision for each in the same order.
+func (p *RetentionPolicy) Evaluate(releases []*StoredRelease, now time.Time) ([]*RetentionDecision, error) {
+	if p.KeepLast <= 0 && p.KeepDeployedWithin <= 0 {
+		return nil, errors.New("retention policy must set KeepLast or KeepDeployedWithin, otherwise every release would be deleted")
+	}
+	if p.KeepDeployedWithin > 0 && p.History == nil {
+		return nil, errors.New("retention policy sets KeepDeployedWithin without a deployment History")
+	}
+
+	sorted := make([]*StoredRelease, len(releases))
+	copy(sorted, releases)
+	sortStoredReleases(sorted)
+	newest := make(map[*StoredRelease]bool)
+	seen := make(map[string]int)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		release := sorted[i]
+		if seen[release.Component] < p.KeepLast {
+			newest[release] = true
+		}
+		seen[release.Component]++
+	}
+
+	result := make([]*RetentionDecision, 0, len(releases))
+	for _, release := range releases {
+		decision := &RetentionDecision{Release: release}
+		if newest[release] {
+			decision.Reasons = append(decision.Reasons, fmt.Sprintf("one of the last %d versions", p.KeepLast))
+		}
+		for _, pinned := range p.Pinned {
+			if pinned.Component == release.Component && pinned.Version == release.Version {
+				decision.Reasons = append(decision.Reasons, fmt.Sprintf("pinned by %s", pinned.Env))
+			}
+		}
+		if p.KeepDeployedWithin > 0 {
+			deployed, err := p.History.LastDeployed(release.Component, release.Version)
+			if err != nil {
+				return nil, fmt.Errorf("error getting deployment history for %s version %s: %s", release.Component, release.Version, err)
+			}
+			if !deployed.IsZero() && now.Sub(deployed) <= p.KeepDeployedWithin {
+				decision.Reasons = append(decision.Reasons, fmt.Sprintf("deployed %s", deployed.UTC().Format(time.RFC3339)))
+			}
+		}
+		decision.Keep = len(decision.Reasons) > 0
+		result = append(result, decision)
+	}
+	return result, nil
+}
+
+// CollectGarbage applies the policy to the releases of a component (or all components if component is empty),
+// writing what it deletes to output. When dryRun is set it only reports what it would delete. It returns the
+// releases that were (or would have been) deleted.
+func CollectGarbage(store ReleaseStore, policy *RetentionPolicy, component string, dryRun bool, output io.Writer) ([]*StoredRelease, error) {
+	releases, err := store.List(component)
+	if err != nil {
+		return nil, fmt.Errorf("error listing releases: %s", err)
+	}
+	decisions, err := policy.Evaluate(releases, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	var deleted []*StoredRelease
+	var size int64
+	for _, decision := range decisions {
+		release := decision.Release
+		if decision.Keep {
+			continue
+		}
+		if dryRun {
+			fmt.Fprintf(output, "would delete %s version %s (%d bytes)\n", release.Component, release.Version, release.Size)
+		} else {
+			if err := store.Delete(release.Component, release.Version); err != nil && err != ErrReleaseNotFound {
+				return deleted, fmt.Errorf("error deleting %s version %s: %s", release.Component, release.Version, err)
+			}
+			fmt.Fprintf(output, "deleted %s version %s (%d bytes)\n", release.Component, release.Version, release.Size)
+		}
+		deleted = append(deleted, release)
+		size += release.Size
+	}
+	verb := "deleted"
+	if dryRun {
+		verb = "would delete"
+	}
+	fmt.Fprintf(output, "%s %d of %d releases (%d bytes)\n", verb, len(deleted), len(releases), size)
+	return deleted, nil
+}
+
+// GC implements a gc command for a config container's main package. It dry-runs by default, printing what it would
+// delete - pass -delete to actually delete releases, and -component to limit it to one component.
+func GC(store ReleaseStore, policy *RetentionPolicy, args []string, output io.Writer) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	flags.SetOutput(output)
+	deleteReleases := flags.Bool("delete", false, "delete releases rather than just listing them")
+	component := flags.String("component", "", "only collect releases of this component")
+	keepLast := flags.Int("keep-last", policy.KeepLast, "number of most recent versions to keep for each component")
+	keepDays := flags.Int("keep-days", int(policy.KeepDeployedWithin/(24*time.Hour)), "keep releases deployed within this many days")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+	effective := *policy
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "keep-last":
+			effective.KeepLast = *keepLast
+		case "keep-days":
+			effective.KeepDeployedWithin = time.Duration(*keepDays) * 24 * time.Hour
+		}
+	})
+	_, err := CollectGarbage(store, &effective, *component, !*deleteReleases, output)
+	return err
+}
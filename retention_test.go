@@ -0,0 +1,112 @@
+package common_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+type fakeDeploymentHistory map[string]time.Time
+
+func (h fakeDeploymentHistory) LastDeployed(component, version string) (time.Time, error) {
+	return h[component+"/"+version], nil
+}
+
+func TestRetentionPolicyEvaluate(t *testing.T) {
+	// Given
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	var releases []*common.StoredRelease
+	for i, version := range []string{"1", "2", "3", "4", "5"} {
+		releases = append(releases, &common.StoredRelease{
+			Component:    "test-component",
+			Version:      version,
+			LastModified: now.Add(time.Duration(i-10) * 24 * time.Hour),
+		})
+	}
+	policy := &common.RetentionPolicy{
+		KeepLast:           2,
+		KeepDeployedWithin: 7 * 24 * time.Hour,
+		History: fakeDeploymentHistory{
+			"test-component/1": now.Add(-30 * 24 * time.Hour),
+			"test-component/2": now.Add(-24 * time.Hour),
+		},
+		Pinned: []*common.PinnedRelease{{Env: "live", Component: "test-component", Version: "3"}},
+	}
+
+	// When
+	decisions, err := policy.Evaluate(releases, now)
+	if err != nil {
+		t.Fatal("error evaluating policy:", err)
+	}
+
+	// Then
+	expected := map[string]bool{"1": false, "2": true, "3": true, "4": true, "5": true}
+	for _, decision := range decisions {
+		if decision.Keep != expected[decision.Release.Version] {
+			t.Errorf("version %s: got keep %v (reasons %v), wanted %v", decision.Release.Version, decision.Keep, decision.Reasons, expected[decision.Release.Version])
+		}
+	}
+	if reasons := strings.Join(decisions[2].Reasons, ", "); reasons != "pinned by live" {
+		t.Errorf("unexpected reasons for version 3: %q", reasons)
+	}
+}
+
+func TestRetentionPolicyRequiresRule(t *testing.T) {
+	if _, err := (&common.RetentionPolicy{}).Evaluate(nil, time.Now()); err == nil {
+		t.Fatal("expected error for a policy that would delete everything")
+	}
+}
+
+func TestGC(t *testing.T) {
+	// Given
+	dir, err := ioutil.TempDir("", "cdflow2-config-common-test-gc")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	defer os.RemoveAll(dir)
+	store := common.CreateFileReleaseStore(dir)
+	for i, version := range []string{"1", "2", "3"} {
+		if err := store.Put("test-component", version, strings.NewReader("release")); err != nil {
+			t.Fatal("error putting release:", err)
+		}
+		modified := time.Now().Add(time.Duration(i-3) * time.Hour)
+		os.Chtimes(filepath.Join(dir, "test-component", version+".zip"), modified, modified)
+	}
+	policy := &common.RetentionPolicy{KeepLast: 1}
+
+	// When
+	var dryRun bytes.Buffer
+	if err := common.GC(store, policy, nil, &dryRun); err != nil {
+		t.Fatal("error in dry run:", err)
+	}
+	releasesAfterDryRun, _ := store.List("test-component")
+	var output bytes.Buffer
+	if err := common.GC(store, policy, []string{"-delete", "-keep-last", "2"}, &output); err != nil {
+		t.Fatal("error collecting garbage:", err)
+	}
+
+	// Then
+	if len(releasesAfterDryRun) != 3 {
+		t.Fatalf("dry run deleted releases: %+v", releasesAfterDryRun)
+	}
+	if !strings.Contains(dryRun.String(), "would delete test-component version 1") ||
+		!strings.Contains(dryRun.String(), "would delete test-component version 2") {
+		t.Fatalf("unexpected dry run output: %q", dryRun.String())
+	}
+	if !strings.Contains(output.String(), "deleted test-component version 1") {
+		t.Fatalf("unexpected output: %q", output.String())
+	}
+	releases, err := store.List("test-component")
+	if err != nil {
+		t.Fatal("error listing releases:", err)
+	}
+	if len(releases) != 2 || releases[0].Version != "2" || releases[1].Version != "3" {
+		t.Fatalf("unexpected releases after gc: %+v", releases)
+	}
+}
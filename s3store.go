@@ -0,0 +1,529 @@
+package common
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultS3PartSize = 16 * 1024 * 1024
+	minS3PartSize     = 5 * 1024 * 1024
+	s3StoreExtension  = ".zip"
+	emptyPayloadHash  = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3ReleaseStoreConfig configures a ReleaseStore backed by an S3-compatible API.
+type S3ReleaseStoreConfig struct {
+	// Endpoint is the base URL of the API, e.g. https://s3.eu-west-1.amazonaws.com or http://localhost:9000.
+	// Requests use path-style addressing ({endpoint}/{bucket}/{key}).
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Team is the first part of the key layout {team}/{component}/{version}.zip. A store only holds the releases of
+	// one team - a config container serving several teams should create a store per team, e.g. with
+	// CreateTeamReleaseStoreHandler, rather than use one store for every request.
+	Team string
+	// AccessKeyID, SecretAccessKey and SessionToken default to AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+	// AWS_SESSION_TOKEN. Requests are sent unsigned if there is no access key.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// PartSize is the size of each part of a multipart upload (releases smaller than this are uploaded in one request),
+	// defaulting to 16MiB.
+	PartSize   int64
+	HTTPClient *http.Client
+}
+
+type s3ReleaseStore struct {
+	config S3ReleaseStoreConfig
+	client *http.Client
+	now    func() time.Time
+}
+
+// CreateS3ReleaseStore returns a ReleaseStore backed by an S3-compatible API.
+func CreateS3ReleaseStore(config *S3ReleaseStoreConfig) (ReleaseStore, error) {
+	result := &s3ReleaseStore{config: *config, client: config.HTTPClient, now: time.Now}
+	if result.config.Endpoint == "" {
+		return nil, errors.New("s3 release store endpoint must be set")
+	}
+	if result.config.Bucket == "" {
+		return nil, errors.New("s3 release store bucket must be set")
+	}
+	if err := validateReleaseKeyPart("team", result.config.Team); err != nil {
+		return nil, err
+	}
+	if result.config.Region == "" {
+		result.config.Region = "us-east-1"
+	}
+	if result.config.PartSize == 0 {
+		result.config.PartSize = defaultS3PartSize
+	}
+	if result.config.PartSize < minS3PartSize {
+		return nil, fmt.Errorf("s3 release store part size must be at least %d bytes", minS3PartSize)
+	}
+	if result.config.AccessKeyID == "" {
+		result.config.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		result.config.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		result.config.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if result.client == nil {
+		result.client = http.DefaultClient
+	}
+	result.config.Endpoint = strings.TrimSuffix(result.config.Endpoint, "/")
+	return result, nil
+}
+
+func (s *s3ReleaseStore) key(component, version string) string {
+	return s.config.Team + "/" + component + "/" + version + s3StoreExtension
+}
+
+// Put uploads the release, in parts if it is larger than the part size. Each request carries a SHA-256 checksum
+// that the server verifies before accepting the data.
+func (s *s3ReleaseStore) Put(component, version string, release io.Reader) error {
+	if err := ValidateReleaseKey(component, version); err != nil {
+		return err
+	}
+	key := s.key(component, version)
+	part := make([]byte, s.config.PartSize)
+	n, err := io.ReadFull(release, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		_, err := s.do(http.MethodPut, key, nil, part[:n], http.StatusOK)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	return s.multipartUpload(key, part, release)
+}
+
+type s3CompletedPart struct {
+	PartNumber     int
+	ETag           string
+	ChecksumSHA256 string
+}
+
+func (s *s3ReleaseStore) multipartUpload(key string, firstPart []byte, release io.Reader) error {
+	uploadID, err := s.createMultipartUpload(key)
+	if err != nil {
+		return err
+	}
+	chunks, err := s.uploadParts(key, uploadID, firstPart, release)
+	if err != nil {
+		if _, abortErr := s.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, http.StatusNoContent); abortErr != nil {
+			return fmt.Errorf("%s (and error aborting upload: %s)", err, abortErr)
+		}
+		return err
+	}
+	return s.completeMultipartUpload(key, uploadID, chunks)
+}
+
+func (s *s3ReleaseStore) createMultipartUpload(key string) (string, error) {
+	response, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, http.StatusOK, "x-amz-checksum-algorithm", "SHA256")
+	if err != nil {
+		return "", err
+	}
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := decodeS3Response(response, &created); err != nil {
+		return "", err
+	}
+	return created.UploadID, nil
+}
+
+func (s *s3ReleaseStore) uploadParts(key, uploadID string, part []byte, release io.Reader) ([]*UploadedChunk, error) {
+	var chunks []*UploadedChunk
+	for index := 0; len(part) > 0; index++ {
+		chunk, err := s.uploadPart(key, uploadID, index, part)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+
+		part = part[:cap(part)]
+		n, err := io.ReadFull(release, part)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		part = part[:n]
+	}
+	return chunks, nil
+}
+
+// uploadPart uploads part number index+1 (S3 part numbers start at one).
+func (s *s3ReleaseStore) uploadPart(key, uploadID string, index int, part []byte) (*UploadedChunk, error) {
+	response, err := s.do(http.MethodPut, key, url.Values{
+		"partNumber": {strconv.Itoa(index + 1)},
+		"uploadId":   {uploadID},
+	}, part, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+	return &UploadedChunk{
+		Index:    index,
+		Checksum: chunkChecksum(part),
+		Ref:      response.Header.Get("ETag"),
+	}, nil
+}
+
+func (s *s3ReleaseStore) completeMultipartUpload(key, uploadID string, chunks []*UploadedChunk) error {
+	parts := make([]s3CompletedPart, len(chunks))
+	for i, chunk := range chunks {
+		parts[i] = s3CompletedPart{PartNumber: chunk.Index + 1, ETag: chunk.Ref, ChecksumSHA256: chunk.Checksum}
+	}
+	complete := struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	response, err := s.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	// S3 can report a failure to complete with a 200 status and an error body
+	var result struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if err := decodeS3Response(response, &result); err != nil {
+		return err
+	}
+	if result.XMLName.Local == "Error" && result.Code == "NoSuchUpload" {
+		return ErrUploadNotFound
+	}
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf("error completing multipart upload of %s: %s: %s", key, result.Code, result.Message)
+	}
+	return nil
+}
+
+// BeginUpload starts a multipart upload, returning its upload ID.
+func (s *s3ReleaseStore) BeginUpload(component, version string) (string, error) {
+	if err := ValidateReleaseKey(component, version); err != nil {
+		return "", err
+	}
+	return s.createMultipartUpload(s.key(component, version))
+}
+
+// PutChunk uploads a chunk as a part of the multipart upload. Every chunk but the last must be at least 5MiB.
+func (s *s3ReleaseStore) PutChunk(component, version, uploadID string, index int, chunk []byte, checksum string) (*UploadedChunk, error) {
+	if err := ValidateReleaseKey(component, version); err != nil {
+		return nil, err
+	}
+	if got := chunkChecksum(chunk); got != checksum {
+		return nil, fmt.Errorf("checksum mismatch for chunk %d, expected %s, got %s", index, checksum, got)
+	}
+	return s.uploadPart(s.key(component, version), uploadID, index, chunk)
+}
+
+func (s *s3ReleaseStore) CompleteUpload(component, version, uploadID string, chunks []*UploadedChunk) error {
+	if err := ValidateReleaseKey(component, version); err != nil {
+		return err
+	}
+	return s.completeMultipartUpload(s.key(component, version), uploadID, chunks)
+}
+
+func (s *s3ReleaseStore) AbortUpload(component, version, uploadID string) error {
+	if err := ValidateReleaseKey(component, version); err != nil {
+		return err
+	}
+	response, err := s.do(http.MethodDelete, s.key(component, version), url.Values{"uploadId": {uploadID}}, nil, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// Get downloads the release, verifying it against the checksum the server stored for it where there is one.
+func (s *s3ReleaseStore) Get(component, version string) (io.ReadCloser, error) {
+	if err := ValidateReleaseKey(component, version); err != nil {
+		return nil, err
+	}
+	response, err := s.do(http.MethodGet, s.key(component, version), nil, nil, http.StatusOK, "x-amz-checksum-mode", "ENABLED")
+	if err != nil {
+		return nil, err
+	}
+	checksum := response.Header.Get("x-amz-checksum-sha256")
+	// multipart uploads have a checksum of checksums, suffixed by the number of parts
+	if checksum == "" || strings.Contains(checksum, "-") {
+		return response.Body, nil
+	}
+	return &checksumVerifyingReader{body: response.Body, hash: sha256.New(), expected: checksum}, nil
+}
+
+type checksumVerifyingReader struct {
+	body     io.ReadCloser
+	hash     hash.Hash
+	expected string
+}
+
+func (r *checksumVerifyingReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF {
+		if got := base64.StdEncoding.EncodeToString(r.hash.Sum(nil)); got != r.expected {
+			return n, fmt.Errorf("release checksum mismatch, expected %s, got %s", r.expected, got)
+		}
+	}
+	return n, err
+}
+
+func (r *checksumVerifyingReader) Close() error {
+	return r.body.Close()
+}
+
+func (s *s3ReleaseStore) Exists(component, version string) (bool, error) {
+	if err := ValidateReleaseKey(component, version); err != nil {
+		return false, err
+	}
+	response, err := s.do(http.MethodHead, s.key(component, version), nil, nil, http.StatusOK)
+	if err == ErrReleaseNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	response.Body.Close()
+	return true, nil
+}
+
+func (s *s3ReleaseStore) List(component string) ([]*StoredRelease, error) {
+	prefix := s.config.Team + "/"
+	if component != "" {
+		if err := validateReleaseKeyPart("component", component); err != nil {
+			return nil, err
+		}
+		prefix += component + "/"
+	}
+	var result []*StoredRelease
+	continuationToken := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		response, err := s.do(http.MethodGet, "", query, nil, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+		var listing struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err := decodeS3Response(response, &listing); err != nil {
+			return nil, err
+		}
+		for _, object := range listing.Contents {
+			parts := strings.Split(strings.TrimPrefix(object.Key, s.config.Team+"/"), "/")
+			if len(parts) != 2 || !strings.HasSuffix(parts[1], s3StoreExtension) {
+				continue
+			}
+			result = append(result, &StoredRelease{
+				Component:    parts[0],
+				Version:      strings.TrimSuffix(parts[1], s3StoreExtension),
+				Size:         object.Size,
+				LastModified: object.LastModified,
+			})
+		}
+		if !listing.IsTruncated {
+			break
+		}
+		continuationToken = listing.NextContinuationToken
+	}
+	sortStoredReleases(result)
+	return result, nil
+}
+
+// Delete removes the release - S3 does not report whether a deleted object existed, so it is checked first.
+func (s *s3ReleaseStore) Delete(component, version string) error {
+	exists, err := s.Exists(component, version)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrReleaseNotFound
+	}
+	response, err := s.do(http.MethodDelete, s.key(component, version), nil, nil, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// do sends a signed request, returning ErrReleaseNotFound for a 404, ErrUploadNotFound for a multipart upload that no
+// longer exists, and an error for any other unexpected status.
+// Extra headers are passed as name, value pairs.
+func (s *s3ReleaseStore) do(method, key string, query url.Values, body []byte, expectedStatus int, headers ...string) (*http.Response, error) {
+	path := "/" + s.config.Bucket
+	if key != "" {
+		path += "/" + key
+	}
+	requestURL := s.config.Endpoint + s3EscapePath(path)
+	if len(query) > 0 {
+		requestURL += "?" + s3CanonicalQuery(query)
+	}
+	request, err := http.NewRequest(method, requestURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.ContentLength = int64(len(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		request.Header.Set(headers[i], headers[i+1])
+	}
+	payloadHash := emptyPayloadHash
+	if body != nil {
+		checksum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(checksum[:])
+		if method == http.MethodPut {
+			request.Header.Set("x-amz-checksum-sha256", base64.StdEncoding.EncodeToString(checksum[:]))
+		}
+	}
+	s.sign(request, path, query, payloadHash)
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == expectedStatus || (expectedStatus == http.StatusNoContent && response.StatusCode == http.StatusOK) {
+		return response, nil
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound && key != "" && query == nil {
+		return nil, ErrReleaseNotFound
+	}
+	var s3Error struct {
+		Code    string
+		Message string
+	}
+	data, _ := ioutil.ReadAll(response.Body)
+	xml.Unmarshal(data, &s3Error)
+	if s3Error.Code == "NoSuchUpload" {
+		return nil, ErrUploadNotFound
+	}
+	return nil, fmt.Errorf("s3 %s %s failed with status %d: %s %s", method, path, response.StatusCode, s3Error.Code, s3Error.Message)
+}
+
+func decodeS3Response(response *http.Response, result interface{}) error {
+	defer response.Body.Close()
+	if err := xml.NewDecoder(response.Body).Decode(result); err != nil {
+		return fmt.Errorf("error decoding s3 response: %s", err)
+	}
+	return nil
+}
+
+// sign adds an AWS signature version 4 Authorization header to the request.
+func (s *s3ReleaseStore) sign(request *http.Request, path string, query url.Values, payloadHash string) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	request.Header.Set("x-amz-date", amzDate)
+	request.Header.Set("x-amz-content-sha256", payloadHash)
+	if s.config.AccessKeyID == "" {
+		return
+	}
+	if s.config.SessionToken != "" {
+		request.Header.Set("x-amz-security-token", s.config.SessionToken)
+	}
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := sortedStringKeys(headers)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		s3EscapePath(path),
+		s3CanonicalQuery(query),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	date := now.Format("20060102")
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretAccessKey), date)
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3EscapePath URI encodes each segment of a path as required for signing.
+func s3EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for _, key := range sortedStringKeys(query) {
+		for _, value := range query[key] {
+			pairs = append(pairs, s3Escape(key)+"="+s3Escape(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape percent encodes everything except unreserved characters, as AWS signature version 4 requires.
+func s3Escape(value string) string {
+	var result strings.Builder
+	for _, b := range []byte(value) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '-' || b == '_' || b == '.' || b == '~' {
+			result.WriteByte(b)
+		} else {
+			fmt.Fprintf(&result, "%%%02X", b)
+		}
+	}
+	return result.String()
+}
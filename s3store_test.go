@@ -0,0 +1,334 @@
+package common_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+type fakeS3Object struct {
+	data         []byte
+	checksum     string
+	lastModified time.Time
+}
+
+// fakeS3 is a minimal stand-in for an S3-compatible API, verifying checksums the way the real thing does.
+type fakeS3 struct {
+	bucket   string
+	mutex    sync.Mutex
+	objects  map[string]*fakeS3Object
+	uploads  map[string]map[int][]byte
+	uploadID int
+	requests []string
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{
+		bucket:  bucket,
+		objects: make(map[string]*fakeS3Object),
+		uploads: make(map[string]map[int][]byte),
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test-access-key/") {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/"+f.bucket) {
+		http.Error(w, "<Error><Code>NoSuchBucket</Code></Error>", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+f.bucket), "/")
+	query := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+	f.requests = append(f.requests, r.Method+" "+r.URL.RawQuery)
+
+	if r.Method == http.MethodPut {
+		sum := sha256.Sum256(body)
+		if r.Header.Get("x-amz-checksum-sha256") != base64.StdEncoding.EncodeToString(sum[:]) {
+			http.Error(w, "<Error><Code>BadDigest</Code></Error>", http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, query.Get("prefix"))
+	case r.Method == http.MethodPost && query.Get("uploads") == "" && strings.Contains(r.URL.RawQuery, "uploads"):
+		f.uploadID++
+		id := fmt.Sprintf("upload-%d", f.uploadID)
+		f.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case query.Get("uploadId") != "" && f.uploads[query.Get("uploadId")] == nil:
+		http.Error(w, "<Error><Code>NoSuchUpload</Code></Error>", http.StatusNotFound)
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		var partNumber int
+		fmt.Sscan(query.Get("partNumber"), &partNumber)
+		f.uploads[query.Get("uploadId")][partNumber] = body
+		w.Header().Set("ETag", fmt.Sprintf("\"etag-%d\"", partNumber))
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		f.completeUpload(w, key, query.Get("uploadId"), body)
+	case r.Method == http.MethodPut:
+		sum := sha256.Sum256(body)
+		f.objects[key] = &fakeS3Object{data: body, checksum: base64.StdEncoding.EncodeToString(sum[:]), lastModified: time.Now()}
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("x-amz-checksum-mode") == "ENABLED" {
+			w.Header().Set("x-amz-checksum-sha256", object.checksum)
+		}
+		w.Write(object.data)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	fmt.Fprint(w, "<ListBucketResult><IsTruncated>false</IsTruncated>")
+	for _, key := range keys {
+		fmt.Fprintf(
+			w, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified></Contents>",
+			key, len(f.objects[key].data), f.objects[key].lastModified.UTC().Format(time.RFC3339Nano),
+		)
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+func (f *fakeS3) completeUpload(w http.ResponseWriter, key, uploadID string, body []byte) {
+	var complete struct {
+		Parts []struct {
+			PartNumber     int
+			ChecksumSHA256 string
+		} `xml:"Part"`
+	}
+	if err := xml.Unmarshal(body, &complete); err != nil {
+		http.Error(w, "<Error><Code>MalformedXML</Code></Error>", http.StatusBadRequest)
+		return
+	}
+	var data []byte
+	var checksums []byte
+	for _, part := range complete.Parts {
+		partData := f.uploads[uploadID][part.PartNumber]
+		sum := sha256.Sum256(partData)
+		if part.ChecksumSHA256 != base64.StdEncoding.EncodeToString(sum[:]) {
+			fmt.Fprint(w, "<Error><Code>InvalidPart</Code><Message>checksum mismatch</Message></Error>")
+			return
+		}
+		data = append(data, partData...)
+		checksums = append(checksums, sum[:]...)
+	}
+	sum := sha256.Sum256(checksums)
+	f.objects[key] = &fakeS3Object{
+		data:         data,
+		checksum:     fmt.Sprintf("%s-%d", base64.StdEncoding.EncodeToString(sum[:]), len(complete.Parts)),
+		lastModified: time.Now(),
+	}
+	delete(f.uploads, uploadID)
+	fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+}
+
+func createS3ReleaseStore(t *testing.T, server *httptest.Server) common.ReleaseStore {
+	t.Helper()
+	store, err := common.CreateS3ReleaseStore(&common.S3ReleaseStoreConfig{
+		Endpoint:        server.URL,
+		Region:          "eu-west-1",
+		Bucket:          "test-bucket",
+		Team:            "test-team",
+		AccessKeyID:     "test-access-key",
+		SecretAccessKey: "test-secret-key",
+		PartSize:        5 * 1024 * 1024,
+	})
+	if err != nil {
+		t.Fatal("error creating s3 release store:", err)
+	}
+	return store
+}
+
+func TestS3ReleaseStore(t *testing.T) {
+	fake := newFakeS3("test-bucket")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	testReleaseStore(t, createS3ReleaseStore(t, server))
+
+	if _, ok := fake.objects["test-team/test-component/2.zip"]; !ok {
+		t.Fatal("expected release to be stored under {team}/{component}/{version}.zip")
+	}
+}
+
+func TestS3ReleaseStoreMultipartUpload(t *testing.T) {
+	// Given
+	fake := newFakeS3("test-bucket")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	store := createS3ReleaseStore(t, server)
+	release := make([]byte, 12*1024*1024)
+	rand.Read(release)
+
+	// When
+	if err := store.Put("test-component", "1", bytes.NewReader(release)); err != nil {
+		t.Fatal("error putting release:", err)
+	}
+	reader, err := store.Get("test-component", "1")
+	if err != nil {
+		t.Fatal("error getting release:", err)
+	}
+	defer reader.Close()
+	got, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal("error reading release:", err)
+	}
+
+	// Then
+	if !bytes.Equal(got, release) {
+		t.Fatal("release does not match")
+	}
+	parts := 0
+	for _, request := range fake.requests {
+		if strings.HasPrefix(request, "PUT partNumber=") {
+			parts++
+		}
+	}
+	if parts != 3 {
+		t.Fatalf("expected 3 parts, got %d in %v", parts, fake.requests)
+	}
+}
+
+func TestS3ReleaseStoreDetectsCorruptDownload(t *testing.T) {
+	// Given
+	fake := newFakeS3("test-bucket")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	store := createS3ReleaseStore(t, server)
+	if err := store.Put("test-component", "1", strings.NewReader("release")); err != nil {
+		t.Fatal("error putting release:", err)
+	}
+	fake.objects["test-team/test-component/1.zip"].data = []byte("corrupt")
+
+	// When
+	reader, err := store.Get("test-component", "1")
+	if err != nil {
+		t.Fatal("error getting release:", err)
+	}
+	defer reader.Close()
+	_, err = ioutil.ReadAll(reader)
+
+	// Then
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatal("expected checksum mismatch error, got:", err)
+	}
+}
+
+func TestS3ReleaseStoreDetectsCorruptTarDownload(t *testing.T) {
+	for _, format := range []common.ReleaseFormat{common.TarGzipFormat, common.TarZstdFormat} {
+		t.Run(format.Extension(), func(t *testing.T) {
+			// Given
+			fake := newFakeS3("test-bucket")
+			server := httptest.NewServer(fake)
+			defer server.Close()
+			store := createS3ReleaseStore(t, server)
+			release := savedRelease(t, format)
+			if err := store.Put("test-component", "1", bytes.NewReader(release)); err != nil {
+				t.Fatal("error putting release:", err)
+			}
+			// past the end of the tar archive, so only the checksum can catch it
+			fake.objects["test-team/test-component/1.zip"].data = append(release, "corrupt"...)
+
+			// When
+			err := loadRelease(t, store, "test-component", "1")
+
+			// Then
+			if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+				t.Fatal("expected checksum mismatch error, got:", err)
+			}
+		})
+	}
+}
+
+// savedRelease returns a release archived in a format.
+func savedRelease(t *testing.T, format common.ReleaseFormat) []byte {
+	t.Helper()
+	release, err := common.CreateReleaseSaverWithFormat(format).Save("test-component", "1", "test-terraform-image", releaseDir(t))
+	if err != nil {
+		t.Fatal("error saving release:", err)
+	}
+	defer release.Close()
+	data, err := ioutil.ReadAll(release)
+	if err != nil {
+		t.Fatal("error reading release:", err)
+	}
+	return data
+}
+
+// loadRelease gets a release from a store and loads it into a temporary directory, returning any error.
+func loadRelease(t *testing.T, store common.ReleaseStore, component, version string) error {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "cdflow2-config-common-test-load-release")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	defer os.RemoveAll(dir)
+	release, err := store.Get(component, version)
+	if err != nil {
+		return err
+	}
+	defer release.Close()
+	_, err = common.CreateReleaseLoader().Load(release, component, version, dir)
+	return err
+}
+
+func TestS3ReleaseStoreReportsLostUpload(t *testing.T) {
+	server := httptest.NewServer(newFakeS3("test-bucket"))
+	defer server.Close()
+	store := createS3ReleaseStore(t, server).(common.ChunkedReleaseStore)
+
+	uploadID, err := store.BeginUpload("test-component", "1")
+	if err != nil {
+		t.Fatal("error beginning upload:", err)
+	}
+	if err := store.AbortUpload("test-component", "1", uploadID); err != nil {
+		t.Fatal("error aborting upload:", err)
+	}
+	chunk := []byte("test-chunk")
+	sum := sha256.Sum256(chunk)
+	if _, err := store.PutChunk("test-component", "1", uploadID, 0, chunk, base64.StdEncoding.EncodeToString(sum[:])); err != common.ErrUploadNotFound {
+		t.Fatalf("got %v, wanted %v", err, common.ErrUploadNotFound)
+	}
+	if err := store.CompleteUpload("test-component", "1", uploadID, nil); err != common.ErrUploadNotFound {
+		t.Fatalf("got %v, wanted %v", err, common.ErrUploadNotFound)
+	}
+}
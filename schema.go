@@ -0,0 +1,310 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// JSONSchemaVersion is the JSON Schema draft the protocol schemas are written in.
+const JSONSchemaVersion = "http://json-schema.org/draft-07/schema#"
+
+// JSONSchema is the subset of JSON Schema used to describe the protocol messages.
+type JSONSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Type                 []string               `json:"type,omitempty"`
+	Enum                 []interface{}          `json:"enum,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *JSONSchema            `json:"additionalProperties,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	// fields are the properties of a struct that encoding/json always writes (all but pointers), which requests are
+	// expected to include.
+	fields []string
+}
+
+// Actions are the values of the Action field of a request, which says which message it is.
+var Actions = []string{"setup", "configure_release", "upload_release", "prepare_terraform"}
+
+var protocolMessages = map[string][2]interface{}{
+	"setup":             {SetupRequest{}, SetupResponse{}},
+	"configure_release": {ConfigureReleaseRequest{}, ConfigureReleaseResponse{}},
+	"upload_release":    {UploadReleaseRequest{}, UploadReleaseResponse{}},
+	"prepare_terraform": {PrepareTerraformRequest{}, PrepareTerraformResponse{}},
+}
+
+// ActionSchema returns the schema of the envelope common to every request, which holds the Action.
+func ActionSchema() *JSONSchema {
+	enum := make([]interface{}, len(Actions))
+	for i, action := range Actions {
+		enum[i] = action
+	}
+	return &JSONSchema{
+		Schema:     JSONSchemaVersion,
+		Title:      "Action",
+		Type:       []string{"object"},
+		Properties: map[string]*JSONSchema{"Action": {Type: []string{"string"}, Enum: enum}},
+		Required:   []string{"Action"},
+	}
+}
+
+// RequestSchema returns the schema of the request for an action, including the Action field.
+func RequestSchema(action string) (*JSONSchema, error) {
+	message, ok := protocolMessages[action]
+	if !ok {
+		return nil, fmt.Errorf("unknown action %q", action)
+	}
+	schema := schemaForType(reflect.TypeOf(message[0]))
+	schema.Schema = JSONSchemaVersion
+	schema.Properties["Action"] = &JSONSchema{Type: []string{"string"}, Enum: []interface{}{action}}
+	schema.Required = []string{"Action"}
+	return schema, nil
+}
+
+// ResponseSchema returns the schema of the response to an action.
+func ResponseSchema(action string) (*JSONSchema, error) {
+	message, ok := protocolMessages[action]
+	if !ok {
+		return nil, fmt.Errorf("unknown action %q", action)
+	}
+	schema := schemaForType(reflect.TypeOf(message[1]))
+	schema.Schema = JSONSchemaVersion
+	return schema, nil
+}
+
+// Schemas returns the schemas of every protocol message, keyed by action and "request" or "response" (e.g.
+// "setup_request"), and the Action envelope as "action".
+func Schemas() map[string]*JSONSchema {
+	result := map[string]*JSONSchema{"action": ActionSchema()}
+	for _, action := range Actions {
+		result[action+"_request"], _ = RequestSchema(action)
+		result[action+"_response"], _ = ResponseSchema(action)
+	}
+	return result
+}
+
+// SchemaCommand implements a schema command for a config container's main package, writing the schema named in args
+// (see Schemas), or all schemas if there are no args, as JSON.
+func SchemaCommand(args []string, output io.Writer) error {
+	var result interface{}
+	switch len(args) {
+	case 0:
+		result = Schemas()
+	case 1:
+		schemas := Schemas()
+		schema, ok := schemas[args[0]]
+		if !ok {
+			return fmt.Errorf("unknown schema %q, expected one of: %s", args[0], strings.Join(sortedStringKeys(schemas), ", "))
+		}
+		result = schema
+	default:
+		return fmt.Errorf("usage: schema [name]")
+	}
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(result)
+}
+
+// schemaForType describes a Go type as it is encoded by encoding/json. Maps, slices and pointers may be null, since
+// that is how encoding/json encodes nil values.
+func schemaForType(t reflect.Type) *JSONSchema {
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := schemaForType(t.Elem())
+		schema.Type = append(schema.Type, "null")
+		return schema
+	case reflect.Interface:
+		return &JSONSchema{}
+	case reflect.String:
+		return &JSONSchema{Type: []string{"string"}}
+	case reflect.Bool:
+		return &JSONSchema{Type: []string{"boolean"}}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &JSONSchema{Type: []string{"integer"}}
+	case reflect.Float32, reflect.Float64:
+		return &JSONSchema{Type: []string{"number"}}
+	case reflect.Slice, reflect.Array:
+		return &JSONSchema{Type: []string{"array", "null"}, Items: schemaForType(t.Elem())}
+	case reflect.Map:
+		return &JSONSchema{Type: []string{"object", "null"}, AdditionalProperties: schemaForType(t.Elem())}
+	case reflect.Struct:
+		schema := &JSONSchema{Title: t.Name(), Type: []string{"object"}, Properties: make(map[string]*JSONSchema)}
+		addStructProperties(schema, t)
+		return schema
+	}
+	panic(fmt.Sprintf("no JSON schema for %s", t))
+}
+
+func addStructProperties(schema *JSONSchema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			addStructProperties(schema, field.Type)
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		schema.Properties[field.Name] = schemaForType(field.Type)
+		if field.Type.Kind() != reflect.Ptr {
+			schema.fields = append(schema.fields, field.Name)
+		}
+	}
+}
+
+// SchemaError is a problem with the value at Path (e.g. $.ReleaseRequirements.release.Needs[0]) in a message.
+type SchemaError struct {
+	Path    string
+	Message string
+}
+
+func (e *SchemaError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// SchemaErrors is every problem found validating a message against a schema.
+type SchemaErrors []*SchemaError
+
+func (e SchemaErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Validate checks that a JSON document matches the schema, returning SchemaErrors if it does not. Property names are
+// matched ignoring case where there is no exact match, as encoding/json does.
+func (s *JSONSchema) Validate(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	var errs SchemaErrors
+	s.validate("$", value, &errs, nil)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ValidateRequest checks a raw request against the schema for its action.
+func ValidateRequest(action string, data []byte) error {
+	schema, err := RequestSchema(action)
+	if err != nil {
+		return err
+	}
+	return schema.Validate(data)
+}
+
+// validate adds the problems with a value to errs. If fields is not nil, unknown fields and missing fields of structs
+// are added to it, in the same pass.
+func (s *JSONSchema) validate(path string, value interface{}, errs *SchemaErrors, fields *SchemaErrors) {
+	if len(s.Type) > 0 && !schemaTypeMatches(s.Type, value) {
+		*errs = append(*errs, &SchemaError{
+			Path:    path,
+			Message: fmt.Sprintf("expected %s, got %s", strings.Join(s.Type, " or "), jsonTypeName(value)),
+		})
+		return
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, option := range s.Enum {
+			if reflect.DeepEqual(option, value) {
+				found = true
+			}
+		}
+		if !found {
+			*errs = append(*errs, &SchemaError{Path: path, Message: fmt.Sprintf("expected one of %v, got %v", s.Enum, value)})
+		}
+	}
+	switch value := value.(type) {
+	case map[string]interface{}:
+		keys := sortedStringKeys(value)
+		for _, name := range s.Required {
+			if matchName(name, keys) == "" {
+				*errs = append(*errs, &SchemaError{Path: path, Message: fmt.Sprintf("missing required property %s", name)})
+			}
+		}
+		names := sortedStringKeys(s.Properties)
+		matched := make(map[string]bool)
+		for _, key := range keys {
+			if name := matchName(key, names); name != "" {
+				matched[name] = true
+				s.Properties[name].validate(path+"."+key, value[key], errs, fields)
+			} else if s.AdditionalProperties != nil {
+				s.AdditionalProperties.validate(path+"."+key, value[key], errs, fields)
+			} else if fields != nil && s.Properties != nil {
+				message := "unknown field " + key
+				if suggestion := suggestFieldName(key, names); suggestion != "" {
+					message += fmt.Sprintf(" (did you mean %s?)", suggestion)
+				}
+				*fields = append(*fields, &SchemaError{Path: path, Message: message})
+			}
+		}
+		if fields != nil {
+			for _, name := range s.fields {
+				if !matched[name] {
+					*fields = append(*fields, &SchemaError{Path: path, Message: "missing field " + name})
+				}
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range value {
+				s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, errs, fields)
+			}
+		}
+	}
+}
+
+// matchName returns the name a key matches - exactly, or else ignoring case as encoding/json does - or "" if there is
+// none. Names are sorted, so a key matching several names ignoring case always matches the same one.
+func matchName(key string, names []string) string {
+	for _, name := range names {
+		if name == key {
+			return name
+		}
+	}
+	for _, name := range names {
+		if strings.EqualFold(name, key) {
+			return name
+		}
+	}
+	return ""
+}
+
+func schemaTypeMatches(types []string, value interface{}) bool {
+	actual := jsonTypeName(value)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonTypeName(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if value == float64(int64(value)) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
@@ -0,0 +1,70 @@
+package common_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func TestRequestSchema(t *testing.T) {
+	// Given
+	schema, err := common.RequestSchema("prepare_terraform")
+	if err != nil {
+		t.Fatal("error getting schema:", err)
+	}
+
+	// Then
+	if schema.Schema != common.JSONSchemaVersion || schema.Title != "PrepareTerraformRequest" {
+		t.Fatalf("unexpected schema: %+v", schema)
+	}
+	if types := schema.Properties["StateShouldExist"].Type; strings.Join(types, ",") != "boolean,null" {
+		t.Fatalf("unexpected StateShouldExist type: %v", types)
+	}
+	if env := schema.Properties["Env"]; env.AdditionalProperties == nil || env.AdditionalProperties.Type[0] != "string" {
+		t.Fatalf("unexpected Env schema: %+v", env)
+	}
+	setup, _ := common.RequestSchema("setup")
+	if setup.Properties["ReleaseRequirements"].AdditionalProperties.Properties["Needs"].Items.Type[0] != "string" {
+		t.Fatal("expected embedded PrepareReleaseRequest fields in the setup request schema")
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	valid := `{"Action": "setup", "Env": null, "Config": {"a": [1, {"b": null}]}, "ReleaseRequirements": {"release": {"needs": ["a"]}}}`
+	if err := common.ValidateRequest("setup", []byte(valid)); err != nil {
+		t.Fatal("expected valid request:", err)
+	}
+
+	invalid := `{"Action": "prepare_terraform", "Version": 1, "Env": {"A": true}, "StateShouldExist": "yes"}`
+	err := common.ValidateRequest("prepare_terraform", []byte(invalid))
+	expected := "$.Env.A: expected string, got boolean; " +
+		"$.StateShouldExist: expected boolean or null, got string; " +
+		"$.Version: expected string, got integer"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("got %v, wanted %q", err, expected)
+	}
+
+	if err := common.ValidateRequest("setup", []byte(`{"Action": "upload_release"}`)); err == nil {
+		t.Fatal("expected error for a mismatched action")
+	}
+}
+
+func TestSchemaCommand(t *testing.T) {
+	var output bytes.Buffer
+	if err := common.SchemaCommand(nil, &output); err != nil {
+		t.Fatal("error writing schemas:", err)
+	}
+	var schemas map[string]*common.JSONSchema
+	if err := json.Unmarshal(output.Bytes(), &schemas); err != nil {
+		t.Fatal("error parsing schemas:", err)
+	}
+	if len(schemas) != 9 || schemas["action"].Properties["Action"].Enum[3] != "prepare_terraform" {
+		t.Fatalf("unexpected schemas: %v", schemas)
+	}
+	if err := common.SchemaCommand([]string{"nope"}, &output); err == nil || !strings.Contains(err.Error(), "setup_request") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SecretReferencePrefix starts a reference to a secret, in the form secret://provider/path#key.
+const SecretReferencePrefix = "secret://"
+
+// SecretProvider gets secrets for a SecretResolver.
+type SecretProvider interface {
+	// GetSecret returns the secret at path. If key is not empty, the secret is a JSON object and the value of key is
+	// returned.
+	GetSecret(path, key string) (string, error)
+}
+
+// DefaultSecretsDir is the directory the built-in "file" secret provider reads secrets from.
+const DefaultSecretsDir = "/run/secrets"
+
+// SecretResolver replaces references to secrets with their values, using the provider named in each reference.
+type SecretResolver struct {
+	providers map[string]SecretProvider
+}
+
+// CreateSecretResolver returns a SecretResolver with the built-in providers registered: "file", which reads
+// secret://file/db#password from DefaultSecretsDir (/run/secrets/db), and "env", which reads secret://env/DB_PASSWORD
+// from the config container's environment.
+func CreateSecretResolver() *SecretResolver {
+	resolver := &SecretResolver{providers: make(map[string]SecretProvider)}
+	resolver.Register("file", CreateFileSecretProvider(DefaultSecretsDir))
+	resolver.Register("env", CreateEnvSecretProvider())
+	return resolver
+}
+
+// Register adds a provider, replacing any provider with the same name.
+func (r *SecretResolver) Register(name string, provider SecretProvider) {
+	r.providers[name] = provider
+}
+
+// Resolve returns the secret a value refers to, or the value itself if it is not a secret reference.
+func (r *SecretResolver) Resolve(value string) (string, error) {
+	if !strings.HasPrefix(value, SecretReferencePrefix) {
+		return value, nil
+	}
+	reference := strings.TrimPrefix(value, SecretReferencePrefix)
+	slash := strings.Index(reference, "/")
+	if slash <= 0 {
+		return "", fmt.Errorf("invalid secret reference %q, expected %sprovider/path#key", value, SecretReferencePrefix)
+	}
+	name, path := reference[:slash], reference[slash+1:]
+	key := ""
+	if hash := strings.LastIndex(path, "#"); hash != -1 {
+		path, key = path[:hash], path[hash+1:]
+	}
+	provider, ok := r.providers[name]
+	if !ok {
+		return "", fmt.Errorf(
+			"unknown secret provider %q in %s, expected one of: %s", name, value, strings.Join(sortedStringKeys(r.providers), ", "),
+		)
+	}
+	secret, err := provider.GetSecret(path, key)
+	if err != nil {
+		return "", fmt.Errorf("error resolving %s: %s", value, err)
+	}
+	return secret, nil
+}
+
+// ResolveEnv replaces the secret references in an env map.
+func (r *SecretResolver) ResolveEnv(env map[string]string) error {
+	for _, name := range sortedStringKeys(env) {
+		value, err := r.Resolve(env[name])
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		env[name] = value
+	}
+	return nil
+}
+
+type fileSecretProvider struct {
+	dir string
+}
+
+// CreateFileSecretProvider returns a SecretProvider that reads secrets from files under a directory. A trailing
+// newline is removed from secrets read without a key.
+func CreateFileSecretProvider(dir string) SecretProvider {
+	return &fileSecretProvider{dir: dir}
+}
+
+func (p *fileSecretProvider) GetSecret(path, key string) (string, error) {
+	filename := filepath.Join(p.dir, filepath.FromSlash(path))
+	if relative, err := filepath.Rel(p.dir, filename); err != nil || strings.HasPrefix(relative, "..") {
+		return "", fmt.Errorf("secret path %q is outside %s", path, p.dir)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	if key == "" {
+		return strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r"), nil
+	}
+	return secretKey(data, key)
+}
+
+type envSecretProvider struct{}
+
+// CreateEnvSecretProvider returns a SecretProvider that reads secrets from environment variables.
+func CreateEnvSecretProvider() SecretProvider {
+	return envSecretProvider{}
+}
+
+func (envSecretProvider) GetSecret(path, key string) (string, error) {
+	value, ok := os.LookupEnv(path)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", path)
+	}
+	if key == "" {
+		return value, nil
+	}
+	return secretKey([]byte(value), key)
+}
+
+func secretKey(data []byte, key string) (string, error) {
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return "", fmt.Errorf("secret with a key must be a JSON object: %s", err)
+	}
+	value, ok := values[key]
+	if !ok {
+		return "", fmt.Errorf("secret has no key %q", key)
+	}
+	if text, ok := value.(string); ok {
+		return text, nil
+	}
+	encoded, err := json.Marshal(value)
+	return string(encoded), err
+}
@@ -0,0 +1,89 @@
+package common_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+type fakeSecretProvider map[string]string
+
+func (p fakeSecretProvider) GetSecret(path, key string) (string, error) {
+	value, ok := p[path+"#"+key]
+	if !ok {
+		return "", errors.New("not found")
+	}
+	return value, nil
+}
+
+func TestSecretResolver(t *testing.T) {
+	// Given
+	dir, err := ioutil.TempDir("", "cdflow2-config-common-test-secrets")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "token"), []byte("file-token\n"), 0600); err != nil {
+		t.Fatal("error writing secret:", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "db.json"), []byte(`{"password": "file-password", "port": 5432}`), 0600); err != nil {
+		t.Fatal("error writing secret:", err)
+	}
+	os.Setenv("CDFLOW2_TEST_SECRET", "env-secret")
+	defer os.Unsetenv("CDFLOW2_TEST_SECRET")
+	resolver := common.CreateSecretResolver()
+	resolver.Register("file", common.CreateFileSecretProvider(dir))
+	resolver.Register("vault", fakeSecretProvider{"kv/app#api_key": "vault-key"})
+	env := map[string]string{
+		"PLAIN":    "not a secret",
+		"TOKEN":    "secret://file/token",
+		"PASSWORD": "secret://file/db.json#password",
+		"PORT":     "secret://file/db.json#port",
+		"ENV":      "secret://env/CDFLOW2_TEST_SECRET",
+		"API_KEY":  "secret://vault/kv/app#api_key",
+	}
+
+	// When
+	if err := resolver.ResolveEnv(env); err != nil {
+		t.Fatal("error resolving secrets:", err)
+	}
+
+	// Then
+	expected := map[string]string{
+		"PLAIN":    "not a secret",
+		"TOKEN":    "file-token",
+		"PASSWORD": "file-password",
+		"PORT":     "5432",
+		"ENV":      "env-secret",
+		"API_KEY":  "vault-key",
+	}
+	for name, value := range expected {
+		if env[name] != value {
+			t.Errorf("%s: got %q, wanted %q", name, env[name], value)
+		}
+	}
+}
+
+func TestSecretResolverErrors(t *testing.T) {
+	resolver := common.CreateSecretResolver()
+	for value, expected := range map[string]string{
+		"secret://nope/x":                 `unknown secret provider "nope" in secret://nope/x, expected one of: env, file`,
+		"secret://env/CDFLOW2_TEST_UNSET": "environment variable CDFLOW2_TEST_UNSET is not set",
+		"secret://":                       "invalid secret reference",
+		"secret://file/../etc/passwd":     "is outside /run/secrets",
+	} {
+		_, err := resolver.Resolve(value)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("resolving %q, got %v, wanted %q", value, err, expected)
+		}
+	}
+	provider := common.CreateFileSecretProvider("/run/secrets")
+	if _, err := provider.GetSecret("../../etc/passwd", ""); err == nil || !strings.Contains(err.Error(), "outside") {
+		t.Fatalf("expected error reading outside the secrets directory, got %v", err)
+	}
+}
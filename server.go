@@ -1,13 +1,11 @@
 package common
 
 import (
-	"archive/zip"
 	"bytes"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"os"
@@ -15,13 +13,8 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
-	"time"
 )
 
-type message struct {
-	Action string
-}
-
 func getSigtermChannel() chan os.Signal {
 	result := make(chan os.Signal, 1)
 	signal.Notify(result, syscall.SIGTERM)
@@ -34,8 +27,45 @@ type AcceptResult struct {
 	err        error
 }
 
-// Listen accepts connections and forwards requests and responses to and from the handler.
+// ListenOptions configures ListenWithOptions.
+type ListenOptions struct {
+	// StrictDecoding refuses requests with unknown or missing fields, rather than logging warnings about them.
+	StrictDecoding bool
+	// SecretResolver, if set, replaces secret references in the Env of responses before they are sent.
+	SecretResolver *SecretResolver
+	// Redactor, if set, removes sensitive values from everything logged while listening. Values of request and response
+	// Env variables with sensitive names, resolved secrets and backend config parameters with a DisplayValue are tracked.
+	Redactor *Redactor
+	// CredentialIssuer, if set, issues a credential for each build in a configure release request and for each
+	// prepare terraform request, adding it to the response Env. Credentials that have not expired are revoked when
+	// Listen stops, or exits on an error.
+	CredentialIssuer CredentialIssuer
+}
+
+// Listen accepts connections and forwards requests and responses to and from the handler, redacting sensitive values
+// from the log. Secret references are only resolved if a SecretResolver is passed to ListenWithOptions.
 func Listen(handler Handler, socketPath, releaseDir string, sigtermChannel chan os.Signal) {
+	ListenWithOptions(handler, socketPath, releaseDir, sigtermChannel, &ListenOptions{Redactor: CreateRedactor()})
+}
+
+// ListenWithOptions is Listen with options. Nil options are the same as empty options.
+func ListenWithOptions(handler Handler, socketPath, releaseDir string, sigtermChannel chan os.Signal, options *ListenOptions) {
+
+	if options == nil {
+		options = &ListenOptions{}
+	}
+
+	if options.Redactor != nil {
+		previous := log.Writer()
+		log.SetOutput(options.Redactor.Writer(previous))
+		defer log.SetOutput(previous)
+	}
+
+	var credentials *credentialTracker
+	if options.CredentialIssuer != nil {
+		credentials = &credentialTracker{issuer: options.CredentialIssuer}
+		defer credentials.revokeAll()
+	}
 
 	if socketPath == "" {
 		socketPath = defaultSocketPath
@@ -67,6 +97,7 @@ func Listen(handler Handler, socketPath, releaseDir string, sigtermChannel chan
 	}()
 
 	var configureReleaseRequest *ConfigureReleaseRequest
+	var configureReleaseResponse *ConfigureReleaseResponse
 
 	for {
 		var acceptResult AcceptResult
@@ -87,22 +118,26 @@ func Listen(handler Handler, socketPath, releaseDir string, sigtermChannel chan
 			log.Panicf("error reading request from unix domain socket %v: %v", socketPath, err)
 		}
 		rawRequest := buffer.Bytes()
-		var request message
-		if err := json.Unmarshal(rawRequest, &request); err != nil {
-			log.Panicln("error reading request:", err)
+		action, err := checkRequest(rawRequest, options.StrictDecoding)
+		if err != nil {
+			exitWithError(err, credentials)
 		}
 		var response interface{}
-		switch request.Action {
+		switch action {
 		case "setup":
-			response = setup(handler, rawRequest)
+			response, err = setup(handler, rawRequest, options)
 		case "configure_release":
-			response, configureReleaseRequest = configureRelease(handler, rawRequest)
+			configureReleaseResponse, configureReleaseRequest, err = configureRelease(handler, rawRequest, options, credentials)
+			response = configureReleaseResponse
 		case "upload_release":
-			response = uploadRelease(handler, rawRequest, configureReleaseRequest, releaseDir)
+			response, err = uploadRelease(handler, rawRequest, configureReleaseRequest, configureReleaseResponse, releaseDir)
 		case "prepare_terraform":
-			response = prepareTerraform(handler, rawRequest, releaseDir)
+			response, err = prepareTerraform(handler, rawRequest, releaseDir, options, credentials)
 		default:
-			log.Panicln("unknown message type:", request.Action)
+			log.Panicln("unknown message type:", action)
+		}
+		if err != nil {
+			exitWithError(err, credentials)
 		}
 		if err := json.NewEncoder(connection).Encode(response); err != nil {
 			log.Panicln("error encoding response:", err)
@@ -111,215 +146,179 @@ func Listen(handler Handler, socketPath, releaseDir string, sigtermChannel chan
 	}
 }
 
-func setup(handler Handler, rawRequest []byte) *SetupResponse {
+// exitWithError logs an error and exits, first revoking the credentials issued while listening, since deferred calls
+// are not run on exit.
+func exitWithError(err error, credentials *credentialTracker) {
+	if credentials != nil {
+		credentials.revokeAll()
+	}
+	log.Fatalln(err)
+}
+
+func setup(handler Handler, rawRequest []byte, options *ListenOptions) (*SetupResponse, error) {
 	var request SetupRequest
 	if err := json.Unmarshal(rawRequest, &request); err != nil {
-		log.Fatalln("error parsing setup request:", err)
+		return nil, fmt.Errorf("error parsing setup request: %s", err)
 	}
+	trackEnv(options, request.Env)
 	response := CreateSetupResponse()
 	if err := handler.Setup(&request, response); err != nil {
-		log.Fatalln("error in Setup:", err)
+		return nil, fmt.Errorf("error in Setup: %s", err)
 	}
-	return response
+	return response, nil
 }
 
-func configureRelease(handler Handler, rawRequest []byte) (*ConfigureReleaseResponse, *ConfigureReleaseRequest) {
+func configureRelease(handler Handler, rawRequest []byte, options *ListenOptions, credentials *credentialTracker) (*ConfigureReleaseResponse, *ConfigureReleaseRequest, error) {
 	var request ConfigureReleaseRequest
 	if err := json.Unmarshal(rawRequest, &request); err != nil {
-		log.Fatalln("error parsing configure release request:", err)
+		return nil, nil, fmt.Errorf("error parsing configure release request: %s", err)
 	}
+	trackEnv(options, request.Env)
 	response := CreateConfigureReleaseResponse()
 	if err := handler.ConfigureRelease(&request, response); err != nil {
-		log.Fatalln("error in ConfigureRelease:", err)
+		return nil, nil, fmt.Errorf("error in ConfigureRelease: %s", err)
+	}
+	if credentials != nil {
+		issued, err := credentials.issueBuildCredentials(&request, response)
+		for _, credential := range issued {
+			trackCredential(options, credential)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error in ConfigureRelease: %s", err)
+		}
+	}
+	for _, buildID := range sortedStringKeys(response.Env) {
+		if err := resolveSecrets(options, response.Env[buildID]); err != nil {
+			return nil, nil, fmt.Errorf("error resolving secrets in ConfigureRelease env for %s: %s", buildID, err)
+		}
 	}
-	return response, &request
+	if err := ValidateConfigureReleaseResponse(response, &request); err != nil {
+		return nil, nil, fmt.Errorf("error in ConfigureRelease: %s", err)
+	}
+	return response, &request, nil
 }
 
-func uploadRelease(handler Handler, rawRequest []byte, configureReleaseRequest *ConfigureReleaseRequest, releaseDir string) *UploadReleaseResponse {
+func uploadRelease(handler Handler, rawRequest []byte, configureReleaseRequest *ConfigureReleaseRequest, configureReleaseResponse *ConfigureReleaseResponse, releaseDir string) (*UploadReleaseResponse, error) {
 	var request UploadReleaseRequest
 	if err := json.Unmarshal(rawRequest, &request); err != nil {
-		log.Fatalln("error parsing upload release request:", err)
+		return nil, fmt.Errorf("error parsing upload release request: %s", err)
 	}
 	response := CreateUploadReleaseResponse()
-	if err := handler.UploadRelease(&request, response, configureReleaseRequest, releaseDir); err != nil {
-		log.Fatalln("error in UploadRelease:", err)
+	if err := uploadConfiguredRelease(handler, &request, response, configureReleaseRequest, configureReleaseResponse, releaseDir); err != nil {
+		return nil, fmt.Errorf("error in UploadRelease: %s", err)
+	}
+	return response, nil
+}
+
+// HandlerWrapper passes every request on to the wrapped Handler, including the configure release response for handlers
+// that implement ConfiguredReleaseUploader. Embed it in handlers that wrap another handler, rather than embedding the
+// Handler itself, so the configure release response (and its AdditionalMetadata) is not lost.
+type HandlerWrapper struct {
+	Handler
+}
+
+// UploadConfiguredRelease passes the configure release response on to the wrapped handler, if it uses it.
+func (w HandlerWrapper) UploadConfiguredRelease(
+	request *UploadReleaseRequest, response *UploadReleaseResponse,
+	configureReleaseRequest *ConfigureReleaseRequest, configureReleaseResponse *ConfigureReleaseResponse,
+	releaseDir string,
+) error {
+	return uploadConfiguredRelease(w.Handler, request, response, configureReleaseRequest, configureReleaseResponse, releaseDir)
+}
+
+// uploadConfiguredRelease calls UploadConfiguredRelease if the handler implements ConfiguredReleaseUploader, or
+// UploadRelease if not.
+func uploadConfiguredRelease(
+	handler Handler, request *UploadReleaseRequest, response *UploadReleaseResponse,
+	configureReleaseRequest *ConfigureReleaseRequest, configureReleaseResponse *ConfigureReleaseResponse,
+	releaseDir string,
+) error {
+	if uploader, ok := handler.(ConfiguredReleaseUploader); ok {
+		return uploader.UploadConfiguredRelease(request, response, configureReleaseRequest, configureReleaseResponse, releaseDir)
 	}
-	return response
+	return handler.UploadRelease(request, response, configureReleaseRequest, releaseDir)
 }
 
-func prepareTerraform(handler Handler, rawRequest []byte, releaseDir string) *PrepareTerraformResponse {
+func prepareTerraform(handler Handler, rawRequest []byte, releaseDir string, options *ListenOptions, credentials *credentialTracker) (*PrepareTerraformResponse, error) {
 	var request PrepareTerraformRequest
 	if err := json.Unmarshal(rawRequest, &request); err != nil {
-		log.Fatalln("error parsing prepare terraform request:", err)
+		return nil, fmt.Errorf("error parsing prepare terraform request: %s", err)
 	}
+	trackEnv(options, request.Env)
 	response := CreatePrepareTerraformResponse()
 	if err := handler.PrepareTerraform(&request, response, releaseDir); err != nil {
-		log.Fatalln("error in PrepareTerraform:", err)
+		return nil, fmt.Errorf("error in PrepareTerraform: %s", err)
+	}
+	if credentials != nil {
+		credential, err := credentials.issueDeployCredential(&request, response)
+		if err != nil {
+			return nil, fmt.Errorf("error in PrepareTerraform: %s", err)
+		}
+		trackCredential(options, credential)
+	}
+	if err := resolveSecrets(options, response.Env); err != nil {
+		return nil, fmt.Errorf("error resolving secrets in PrepareTerraform env: %s", err)
+	}
+	if options.Redactor != nil {
+		options.Redactor.TrackBackendConfigParameters(response.TerraformBackendConfigParameters)
 	}
-	return response
+	if err := ValidatePrepareTerraformResponse(response); err != nil {
+		return nil, fmt.Errorf("error in PrepareTerraform: %s", err)
+	}
+	return response, nil
 }
 
-func sha256File(reader io.Reader) (string, error) {
-	h := sha256.New()
-	if _, err := io.Copy(h, reader); err != nil {
-		return "", err
+// trackEnv marks the sensitive values in an env map, if there is a Redactor.
+func trackEnv(options *ListenOptions, env map[string]string) {
+	if options.Redactor != nil {
+		options.Redactor.TrackEnv(env)
 	}
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
 
-type savedPlugin struct {
-	Path     string
-	Checksum string
-	Mode     os.FileMode
+// trackCredential marks the values of a credential as sensitive, if there is a Redactor.
+func trackCredential(options *ListenOptions, credential *Credential) {
+	if options.Redactor != nil {
+		for _, value := range credential.Env {
+			options.Redactor.AddSecret(value)
+		}
+	}
 }
 
-// ZipRelease zips the release folder to a stream.
-func ZipRelease(
-	writer io.Writer, dir, component, version, terraformImage string,
-) error {
-	if component == "" {
-		panic("no component")
+// resolveSecrets replaces the secret references in an env map, if there is a SecretResolver, marking the secrets and
+// other sensitive values as sensitive if there is a Redactor.
+func resolveSecrets(options *ListenOptions, env map[string]string) error {
+	if options.SecretResolver == nil {
+		trackEnv(options, env)
+		return nil
 	}
-	prefix := component + "-" + version
-	zipWriter := zip.NewWriter(writer)
-	terraformImageFilename := filepath.Join(prefix, "terraform-image")
-	writer, err := zipWriter.Create(terraformImageFilename)
-	if err != nil {
+	var references []string
+	for name, value := range env {
+		if strings.HasPrefix(value, SecretReferencePrefix) {
+			references = append(references, name)
+		}
+	}
+	if err := options.SecretResolver.ResolveEnv(env); err != nil {
 		return err
 	}
-	writer.Write([]byte(terraformImage))
-
-	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		relativePath, err := filepath.Rel(dir, path)
-		if err != nil {
-			return err
-		}
-
-		reader, err := os.Open(path)
-		if err != nil {
-			return fmt.Errorf("cdflow2-config-common: error opening %s for reading: %s", path, err)
-		}
-
-		if fileInfo, err := reader.Stat(); err != nil || fileInfo.IsDir() {
-			return err
-		}
-
-		defer reader.Close()
-
-		header, err := zip.FileInfoHeader(info)
-		if err != nil {
-			return err
+	if options.Redactor != nil {
+		for _, name := range references {
+			options.Redactor.AddSecret(env[name])
 		}
-		header.Name = filepath.Join(prefix, relativePath)
-
-		writer, err := zipWriter.CreateHeader(header)
-		if err != nil {
-			return err
-		}
-
-		_, err = io.Copy(writer, reader)
-		if err != nil {
-			return err
-		}
-
-		return nil
-	}); err != nil {
-		return err
 	}
-
-	return zipWriter.Close()
-}
-
-type dummyFileInfo struct {
-	size int64
-	mode os.FileMode
-}
-
-func (dummyFileInfo) Name() string {
-	return ""
-}
-
-func (d dummyFileInfo) Size() int64 {
-	return d.size
-}
-
-func (d dummyFileInfo) Mode() os.FileMode {
-	return d.mode
-}
-
-func (dummyFileInfo) ModTime() time.Time {
-	return time.Now()
-}
-
-func (dummyFileInfo) IsDir() bool {
-	return false
-}
-
-func (dummyFileInfo) Sys() interface{} {
+	trackEnv(options, env)
 	return nil
 }
 
-// UnzipRelease unzips the release.
-func UnzipRelease(
-	reader io.Reader, dir, component, version string,
-) (string, error) {
-	contents, err := ioutil.ReadAll(reader)
-	if err != nil {
-		return "", err
-	}
-	zipReader, err := zip.NewReader(bytes.NewReader(contents), int64(len(contents)))
-	if err != nil {
+func sha256File(reader io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, reader); err != nil {
 		return "", err
 	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
 
-	prefix := component + "-" + version
-
-	var terraformImageBuffer bytes.Buffer
-	for _, file := range zipReader.File {
-		if file.FileInfo().IsDir() {
-			continue
-		}
-		if file.Name[0] == '/' {
-			return "", fmt.Errorf("error in release zip, unexpected absolute path \"%v\"", file.Name[0])
-		}
-
-		parts := strings.Split(file.Name, "/")
-		if parts[0] != prefix {
-			return "", fmt.Errorf("error in release zip, expected prefix \"%v\", got \"%v\"", prefix, parts[0])
-		}
-
-		reader, err := file.Open()
-		if err != nil {
-			return "", err
-		}
-		defer reader.Close()
-
-		if len(parts) == 2 && parts[1] == "terraform-image" {
-			io.Copy(&terraformImageBuffer, reader)
-			continue
-		}
-
-		destFilename := filepath.Join(dir, filepath.Join(parts[1:]...))
-		if !strings.Contains(destFilename, "..") {
-			if err = os.MkdirAll(filepath.Dir(destFilename), os.FileMode(0755)); err != nil {
-				return "", err
-			}
-			writer, err := os.OpenFile(destFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.Mode())
-			if err != nil {
-				return "", err
-			}
-			defer writer.Close()
-			if _, err := io.Copy(writer, reader); err != nil {
-				return "", err
-			}
-		}
-	}
-	if terraformImageBuffer.String() == "" {
-		panic("did not find terraform-image in zip")
-	}
-	return string(terraformImageBuffer.String()), nil
+type savedPlugin struct {
+	Path     string
+	Checksum string
+	Mode     os.FileMode
 }
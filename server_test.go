@@ -57,6 +57,31 @@ func TestRun(t *testing.T) {
 	sigtermChannel <- FakeSigterm{}
 }
 
+func TestListenWithNilOptions(t *testing.T) {
+	// Given
+	socketPath := tempSock(t)
+	defer os.Remove(socketPath)
+	sigtermChannel := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	go func() {
+		common.ListenWithOptions(&stubHandler{}, socketPath, releaseDir(t), sigtermChannel, nil)
+		close(done)
+	}()
+
+	// When
+	response, err := forward(map[string]interface{}{"Action": "setup"}, socketPath)
+	sigtermChannel <- FakeSigterm{}
+	<-done
+
+	// Then
+	if err != nil {
+		t.Fatal("error calling setup:", err)
+	}
+	if response["Success"] != true {
+		t.Fatal("unexpected setup response:", response)
+	}
+}
+
 func forward(request interface{}, socketPath string) (map[string]interface{}, error) {
 	var requestBuffer bytes.Buffer
 	var responseBuffer bytes.Buffer
@@ -126,7 +151,7 @@ func checkSetup(t *testing.T, errorBuffer *bytes.Buffer, socketPath string) {
 
 func (handler *handler) ConfigureRelease(request *common.ConfigureReleaseRequest, response *common.ConfigureReleaseResponse) error {
 	fmt.Fprintf(handler.errorStream, "version: %v, env key: %v, config key: %v\n", request.Version, request.Env["env-key"], request.Config["config-key"])
-	response.Env["build-id"] = map[string]string{"response-env-key": "response-env-value"}
+	response.Env["release"] = map[string]string{"RESPONSE_ENV_KEY": "response-env-value"}
 	response.AdditionalMetadata["foo"] = "bar"
 
 	response.Monitoring = &common.Monitoring{
@@ -186,8 +211,8 @@ func checkRelease(t *testing.T, errorBuffer *bytes.Buffer, socketPath string) {
 	}
 	if fmt.Sprintf("%v", configureReleaseResponse) != fmt.Sprintf("%v", map[string]interface{}{
 		"Env": map[string]map[string]string{
-			"build-id": {
-				"response-env-key": "response-env-value",
+			"release": {
+				"RESPONSE_ENV_KEY": "response-env-value",
 			},
 		},
 		"AdditionalMetadata": map[string]string{
@@ -238,7 +263,7 @@ func checkRelease(t *testing.T, errorBuffer *bytes.Buffer, socketPath string) {
 func (handler *handler) PrepareTerraform(request *common.PrepareTerraformRequest, response *common.PrepareTerraformResponse, releaseDir string) error {
 	fmt.Fprintf(handler.errorStream, "version: %v, env name: %v, config value: %v, env value: %v\n", request.Version, request.EnvName, request.Config["config-key"], request.Env["env-key"])
 	response.Env = map[string]string{
-		"response-env-key": "response-env-value",
+		"RESPONSE_ENV_KEY": "response-env-value",
 	}
 	response.TerraformImage = "test-terraform-image"
 	response.TerraformBackendType = "test-backend-type"
@@ -288,7 +313,7 @@ func checkPrepareTerraform(t *testing.T, errorBuffer *bytes.Buffer, socketPath s
 
 	if fmt.Sprintf("%v", prepareTerraformResponse) != fmt.Sprintf("%v", map[string]interface{}{
 		"Env": map[string]string{
-			"response-env-key": "response-env-value",
+			"RESPONSE_ENV_KEY": "response-env-value",
 		},
 		"TerraformBackendConfig": map[string]string{
 			"backend-key": "backend-value",
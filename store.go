@@ -0,0 +1,152 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrReleaseNotFound is returned by a ReleaseStore when the requested release does not exist.
+var ErrReleaseNotFound = errors.New("release not found")
+
+// ErrUploadNotFound is returned by a ChunkedReleaseStore when an upload no longer exists, e.g. because it was aborted
+// or expired.
+var ErrUploadNotFound = errors.New("upload not found")
+
+// ValidateReleaseKey checks that a component and version are safe to use as a key in a ReleaseStore.
+func ValidateReleaseKey(component, version string) error {
+	if err := validateReleaseKeyPart("component", component); err != nil {
+		return err
+	}
+	return validateReleaseKeyPart("version", version)
+}
+
+func validateReleaseKeyPart(name, value string) error {
+	if value == "" {
+		return fmt.Errorf("release %s must not be empty", name)
+	}
+	if value == "." || value == ".." || strings.HasPrefix(value, ".") || strings.ContainsAny(value, "/\\") {
+		return fmt.Errorf("invalid release %s %q", name, value)
+	}
+	return nil
+}
+
+// sortStoredReleases orders releases oldest first, falling back to component and version for a stable order.
+func sortStoredReleases(releases []*StoredRelease) {
+	sort.SliceStable(releases, func(i, j int) bool {
+		if !releases[i].LastModified.Equal(releases[j].LastModified) {
+			return releases[i].LastModified.Before(releases[j].LastModified)
+		}
+		if releases[i].Component != releases[j].Component {
+			return releases[i].Component < releases[j].Component
+		}
+		return releases[i].Version < releases[j].Version
+	})
+}
+
+// ReleaseStoreHandler implements UploadRelease and PrepareTerraform by saving releases to and loading them from a
+// ReleaseStore. It can be embedded in a handler that implements the remaining Handler methods.
+//
+// Stores that implement ChunkedReleaseStore are uploaded to in chunks of ChunkSize, resuming interrupted uploads.
+type ReleaseStoreHandler struct {
+	Store ReleaseStore
+	// TeamStore, if set, is used instead of Store to get the store for the team of each request. Stores such as the S3
+	// store are configured with a team that starts their key layout, so a config container serving several teams needs
+	// a store for each.
+	TeamStore func(team string) (ReleaseStore, error)
+	Saver     ReleaseSaver
+	Loader    ReleaseLoader
+	ChunkSize int64
+}
+
+// CreateReleaseStoreHandler returns a ReleaseStoreHandler for the store, using the default saver and loader.
+func CreateReleaseStoreHandler(store ReleaseStore) *ReleaseStoreHandler {
+	return &ReleaseStoreHandler{
+		Store:     store,
+		Saver:     CreateReleaseSaver(),
+		Loader:    CreateReleaseLoader(),
+		ChunkSize: DefaultChunkSize,
+	}
+}
+
+// CreateTeamReleaseStoreHandler returns a ReleaseStoreHandler that gets the store for the team of each request from
+// teamStore, using the default saver and loader.
+func CreateTeamReleaseStoreHandler(teamStore func(team string) (ReleaseStore, error)) *ReleaseStoreHandler {
+	handler := CreateReleaseStoreHandler(nil)
+	handler.TeamStore = teamStore
+	return handler
+}
+
+// store returns the store for a team.
+func (h *ReleaseStoreHandler) store(team string) (ReleaseStore, error) {
+	if h.TeamStore == nil {
+		return h.Store, nil
+	}
+	store, err := h.TeamStore(team)
+	if err != nil {
+		return nil, fmt.Errorf("error getting release store for team %s: %s", team, err)
+	}
+	return store, nil
+}
+
+// UploadRelease saves the release and puts it in the store, without any additional metadata.
+func (h *ReleaseStoreHandler) UploadRelease(request *UploadReleaseRequest, response *UploadReleaseResponse, configureReleaseRequest *ConfigureReleaseRequest, releaseDir string) error {
+	return h.UploadConfiguredRelease(request, response, configureReleaseRequest, nil, releaseDir)
+}
+
+// UploadConfiguredRelease saves the release, including the additional metadata from the configure release response, and
+// puts it in the store.
+func (h *ReleaseStoreHandler) UploadConfiguredRelease(
+	request *UploadReleaseRequest, response *UploadReleaseResponse,
+	configureReleaseRequest *ConfigureReleaseRequest, configureReleaseResponse *ConfigureReleaseResponse,
+	releaseDir string,
+) error {
+	releaseInfo, err := CreateReleaseInfo(request, configureReleaseRequest, configureReleaseResponse)
+	if err != nil {
+		return err
+	}
+	store, err := h.store(releaseInfo.Team)
+	if err != nil {
+		return err
+	}
+	if chunkedStore, ok := store.(ChunkedReleaseStore); ok && h.ChunkSize > 0 {
+		if err := UploadReleaseResumable(chunkedStore, h.Saver, releaseInfo, releaseDir, h.ChunkSize); err != nil {
+			return err
+		}
+		response.Message = fmt.Sprintf("stored release %s version %s", releaseInfo.Component, releaseInfo.Version)
+		return nil
+	}
+	release, err := saveReleaseWithInfo(h.Saver, releaseInfo, releaseDir)
+	if err != nil {
+		return fmt.Errorf("error saving release: %s", err)
+	}
+	defer release.Close()
+	if err := store.Put(releaseInfo.Component, releaseInfo.Version, release); err != nil {
+		return fmt.Errorf("error storing release: %s", err)
+	}
+	response.Message = fmt.Sprintf("stored release %s version %s", releaseInfo.Component, releaseInfo.Version)
+	return nil
+}
+
+// PrepareTerraform gets the release from the store and loads it into the release directory.
+func (h *ReleaseStoreHandler) PrepareTerraform(request *PrepareTerraformRequest, response *PrepareTerraformResponse, releaseDir string) error {
+	store, err := h.store(request.Team)
+	if err != nil {
+		return err
+	}
+	release, err := store.Get(request.Component, request.Version)
+	if err == ErrReleaseNotFound {
+		return fmt.Errorf("release %s version %s not found", request.Component, request.Version)
+	}
+	if err != nil {
+		return fmt.Errorf("error getting release: %s", err)
+	}
+	defer release.Close()
+	terraformImage, err := h.Loader.Load(release, request.Component, request.Version, releaseDir)
+	if err != nil {
+		return err
+	}
+	response.TerraformImage = terraformImage
+	return nil
+}
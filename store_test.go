@@ -0,0 +1,326 @@
+package common_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+// testReleaseStore checks the behaviour every ReleaseStore implementation should share.
+func testReleaseStore(t *testing.T, store common.ReleaseStore) {
+	t.Helper()
+
+	// missing release
+	if exists, err := store.Exists("test-component", "1"); err != nil || exists {
+		t.Fatalf("expected release not to exist, exists: %v, error: %v", exists, err)
+	}
+	if _, err := store.Get("test-component", "1"); err != common.ErrReleaseNotFound {
+		t.Fatalf("got %v, wanted %v", err, common.ErrReleaseNotFound)
+	}
+	if err := store.Delete("test-component", "1"); err != common.ErrReleaseNotFound {
+		t.Fatalf("got %v, wanted %v", err, common.ErrReleaseNotFound)
+	}
+
+	// put and get
+	for _, version := range []string{"1", "2"} {
+		if err := store.Put("test-component", version, strings.NewReader("release "+version)); err != nil {
+			t.Fatal("error putting release:", err)
+		}
+	}
+	if err := store.Put("other-component", "1", strings.NewReader("other release")); err != nil {
+		t.Fatal("error putting release:", err)
+	}
+	if exists, err := store.Exists("test-component", "1"); err != nil || !exists {
+		t.Fatalf("expected release to exist, exists: %v, error: %v", exists, err)
+	}
+	reader, err := store.Get("test-component", "2")
+	if err != nil {
+		t.Fatal("error getting release:", err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(data) != "release 2" {
+		t.Fatalf("problem reading release, data: %q, error: %v", data, err)
+	}
+
+	// list
+	releases, err := store.List("test-component")
+	if err != nil {
+		t.Fatal("error listing releases:", err)
+	}
+	if len(releases) != 2 || releases[0].Version != "1" || releases[1].Version != "2" {
+		t.Fatalf("unexpected releases: %+v", releases)
+	}
+	if releases[0].Component != "test-component" || releases[0].Size != int64(len("release 1")) {
+		t.Fatalf("unexpected release: %+v", releases[0])
+	}
+	allReleases, err := store.List("")
+	if err != nil {
+		t.Fatal("error listing releases:", err)
+	}
+	if len(allReleases) != 3 {
+		t.Fatalf("expected 3 releases, got %+v", allReleases)
+	}
+
+	// delete
+	if err := store.Delete("test-component", "1"); err != nil {
+		t.Fatal("error deleting release:", err)
+	}
+	if exists, err := store.Exists("test-component", "1"); err != nil || exists {
+		t.Fatalf("expected release to be deleted, exists: %v, error: %v", exists, err)
+	}
+
+	// invalid keys
+	if err := store.Put("../escape", "1", strings.NewReader("")); err == nil {
+		t.Fatal("expected error for invalid component")
+	}
+	if _, err := store.Get("test-component", ""); err == nil {
+		t.Fatal("expected error for empty version")
+	}
+}
+
+func TestReleaseStoreHandler(t *testing.T) {
+	// Given
+	storeDir, err := ioutil.TempDir("", "cdflow2-config-common-test-store-handler")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	defer os.RemoveAll(storeDir)
+	destDir, err := ioutil.TempDir("", "cdflow2-config-common-test-store-handler-dest")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	defer os.RemoveAll(destDir)
+
+	store := common.CreateFileReleaseStore(storeDir)
+	handler := common.CreateReleaseStoreHandler(store)
+
+	uploadReleaseRequest := common.CreateUploadReleaseRequest()
+	uploadReleaseRequest.TerraformImage = "test-terraform-image"
+	configureReleaseRequest := common.CreateConfigureReleaseRequest()
+	configureReleaseRequest.Component = "test-component"
+	configureReleaseRequest.Version = "test-version"
+	configureReleaseResponse := common.CreateConfigureReleaseResponse()
+	configureReleaseResponse.AdditionalMetadata["foo"] = "bar"
+	uploadReleaseResponse := common.CreateUploadReleaseResponse()
+
+	// When
+	if err := handler.UploadConfiguredRelease(
+		uploadReleaseRequest, uploadReleaseResponse, configureReleaseRequest, configureReleaseResponse, releaseDir(t),
+	); err != nil {
+		t.Fatal("error uploading release:", err)
+	}
+	prepareTerraformRequest := common.CreatePrepareTerraformRequest()
+	prepareTerraformRequest.Component = "test-component"
+	prepareTerraformRequest.Version = "test-version"
+	prepareTerraformResponse := common.CreatePrepareTerraformResponse()
+	if err := handler.PrepareTerraform(prepareTerraformRequest, prepareTerraformResponse, destDir); err != nil {
+		t.Fatal("error preparing terraform:", err)
+	}
+
+	// Then
+	if prepareTerraformResponse.TerraformImage != "test-terraform-image" {
+		t.Fatalf("got %q, wanted %q", prepareTerraformResponse.TerraformImage, "test-terraform-image")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(destDir, "test.txt")); err != nil || string(data) != "test" {
+		t.Fatalf("problem reading file, data: %v, error: %v\n", data, err)
+	}
+	release, err := store.Get("test-component", "test-version")
+	if err != nil {
+		t.Fatal("error getting release:", err)
+	}
+	defer release.Close()
+	var buffer bytes.Buffer
+	buffer.ReadFrom(release)
+	releaseInfo, err := common.ReadReleaseInfo(&buffer)
+	if err != nil {
+		t.Fatal("error reading release info:", err)
+	}
+	if releaseInfo.Component != "test-component" || releaseInfo.TerraformImage != "test-terraform-image" ||
+		releaseInfo.AdditionalMetadata["foo"] != "bar" {
+		t.Fatalf("unexpected release info: %+v", releaseInfo)
+	}
+}
+
+func TestTeamReleaseStoreHandler(t *testing.T) {
+	// Given
+	storeDir, err := ioutil.TempDir("", "cdflow2-config-common-test-store-handler-teams")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	defer os.RemoveAll(storeDir)
+	handler := common.CreateTeamReleaseStoreHandler(func(team string) (common.ReleaseStore, error) {
+		return common.CreateFileReleaseStore(filepath.Join(storeDir, team)), nil
+	})
+
+	// When
+	for _, team := range []string{"team-a", "team-b"} {
+		uploadReleaseRequest := common.CreateUploadReleaseRequest()
+		uploadReleaseRequest.TerraformImage = team + "-terraform-image"
+		configureReleaseRequest := common.CreateConfigureReleaseRequest()
+		configureReleaseRequest.Team = team
+		configureReleaseRequest.Component = "test-component"
+		configureReleaseRequest.Version = "1"
+		if err := handler.UploadRelease(
+			uploadReleaseRequest, common.CreateUploadReleaseResponse(), configureReleaseRequest, releaseDir(t),
+		); err != nil {
+			t.Fatal("error uploading release:", err)
+		}
+	}
+
+	// Then
+	for _, team := range []string{"team-a", "team-b"} {
+		request := common.CreatePrepareTerraformRequest()
+		request.Team = team
+		request.Component = "test-component"
+		request.Version = "1"
+		response := common.CreatePrepareTerraformResponse()
+		destDir := filepath.Join(storeDir, "dest-"+team)
+		if err := handler.PrepareTerraform(request, response, destDir); err != nil {
+			t.Fatal("error preparing terraform:", err)
+		}
+		if response.TerraformImage != team+"-terraform-image" {
+			t.Fatalf("got %q for %s, wanted %q", response.TerraformImage, team, team+"-terraform-image")
+		}
+	}
+}
+
+// wrappingHandler is a handler wrapper written outside this package.
+type wrappingHandler struct {
+	common.HandlerWrapper
+}
+
+// storeBackedHandler is a Handler that keeps releases in a ReleaseStore.
+type storeBackedHandler struct {
+	*common.ReleaseStoreHandler
+}
+
+func (storeBackedHandler) Setup(*common.SetupRequest, *common.SetupResponse) error {
+	return nil
+}
+
+func (storeBackedHandler) ConfigureRelease(*common.ConfigureReleaseRequest, *common.ConfigureReleaseResponse) error {
+	return nil
+}
+
+func TestWrappedReleaseStoreHandlerKeepsAdditionalMetadata(t *testing.T) {
+	// Given
+	storeDir, err := ioutil.TempDir("", "cdflow2-config-common-test-store-handler-wrapped")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	defer os.RemoveAll(storeDir)
+	store := common.CreateFileReleaseStore(storeDir)
+	ledger, cleanup := createLedger(t)
+	defer cleanup()
+	gated := common.CreateGatedHandler(storeBackedHandler{common.CreateReleaseStoreHandler(store)})
+	handler := common.CreateLedgerHandler(&wrappingHandler{common.HandlerWrapper{Handler: gated}}, ledger)
+	uploadReleaseRequest := common.CreateUploadReleaseRequest()
+	uploadReleaseRequest.TerraformImage = "test-terraform-image"
+	configureReleaseRequest := common.CreateConfigureReleaseRequest()
+	configureReleaseRequest.Component = "test-component"
+	configureReleaseRequest.Version = "test-version"
+	configureReleaseResponse := common.CreateConfigureReleaseResponse()
+	configureReleaseResponse.AdditionalMetadata["foo"] = "bar"
+
+	// When
+	uploader, ok := handler.(common.ConfiguredReleaseUploader)
+	if !ok {
+		t.Fatal("expected wrapped handler to be a ConfiguredReleaseUploader")
+	}
+	if err := uploader.UploadConfiguredRelease(
+		uploadReleaseRequest, common.CreateUploadReleaseResponse(), configureReleaseRequest, configureReleaseResponse, releaseDir(t),
+	); err != nil {
+		t.Fatal("error uploading release:", err)
+	}
+
+	// Then
+	release, err := store.Get("test-component", "test-version")
+	if err != nil {
+		t.Fatal("error getting release:", err)
+	}
+	defer release.Close()
+	releaseInfo, err := common.ReadReleaseInfo(release)
+	if err != nil {
+		t.Fatal("error reading release info:", err)
+	}
+	if releaseInfo.AdditionalMetadata["foo"] != "bar" {
+		t.Fatalf("unexpected release info: %+v", releaseInfo)
+	}
+}
+
+// plainReleaseSaver and plainReleaseLoader only implement ReleaseSaver and ReleaseLoader, like savers and loaders
+// written before release info was added.
+type plainReleaseSaver struct{ common.ReleaseSaver }
+type plainReleaseLoader struct{ common.ReleaseLoader }
+
+func TestReleaseStoreHandlerWithPlainSaverAndLoader(t *testing.T) {
+	// Given
+	storeDir, err := ioutil.TempDir("", "cdflow2-config-common-test-store-handler-plain")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	defer os.RemoveAll(storeDir)
+	handler := common.CreateReleaseStoreHandler(common.CreateFileReleaseStore(storeDir))
+	handler.Saver = plainReleaseSaver{common.CreateReleaseSaver()}
+	handler.Loader = plainReleaseLoader{common.CreateReleaseLoader()}
+	uploadReleaseRequest := common.CreateUploadReleaseRequest()
+	uploadReleaseRequest.TerraformImage = "test-terraform-image"
+	configureReleaseRequest := common.CreateConfigureReleaseRequest()
+	configureReleaseRequest.Component = "test-component"
+	configureReleaseRequest.Version = "test-version"
+
+	// When
+	if err := handler.UploadRelease(
+		uploadReleaseRequest, common.CreateUploadReleaseResponse(), configureReleaseRequest, releaseDir(t),
+	); err != nil {
+		t.Fatal("error uploading release:", err)
+	}
+	prepareTerraformRequest := common.CreatePrepareTerraformRequest()
+	prepareTerraformRequest.Component = "test-component"
+	prepareTerraformRequest.Version = "test-version"
+	prepareTerraformResponse := common.CreatePrepareTerraformResponse()
+	defer os.RemoveAll(storeDir + "-dest")
+	if err := handler.PrepareTerraform(prepareTerraformRequest, prepareTerraformResponse, storeDir+"-dest"); err != nil {
+		t.Fatal("error preparing terraform:", err)
+	}
+
+	// Then
+	if prepareTerraformResponse.TerraformImage != "test-terraform-image" {
+		t.Fatalf("got %q, wanted %q", prepareTerraformResponse.TerraformImage, "test-terraform-image")
+	}
+}
+
+func TestReleaseStoreHandlerWithoutConfigureRelease(t *testing.T) {
+	storeDir, err := ioutil.TempDir("", "cdflow2-config-common-test-store-handler-unconfigured")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	defer os.RemoveAll(storeDir)
+	handler := common.CreateReleaseStoreHandler(common.CreateFileReleaseStore(storeDir))
+	err = handler.UploadRelease(common.CreateUploadReleaseRequest(), common.CreateUploadReleaseResponse(), nil, releaseDir(t))
+	if err == nil || !strings.Contains(err.Error(), "no configure release request") {
+		t.Fatal("expected error for upload without configure release, got:", err)
+	}
+}
+
+func TestReleaseStoreHandlerMissingRelease(t *testing.T) {
+	storeDir, err := ioutil.TempDir("", "cdflow2-config-common-test-store-handler-missing")
+	if err != nil {
+		t.Fatal("error creating temporary directory:", err)
+	}
+	defer os.RemoveAll(storeDir)
+	handler := common.CreateReleaseStoreHandler(common.CreateFileReleaseStore(storeDir))
+	request := common.CreatePrepareTerraformRequest()
+	request.Component = "test-component"
+	request.Version = "missing"
+	err = handler.PrepareTerraform(request, common.CreatePrepareTerraformResponse(), storeDir)
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatal("expected not found error, got:", err)
+	}
+}
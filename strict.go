@@ -0,0 +1,94 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// CheckRequestFields compares the fields in a raw request with the request type for its action, returning a
+// SchemaError for each unknown field (with a suggestion if it looks like a misnamed field) and each missing field.
+// Every field is expected apart from pointers, which are optional.
+func CheckRequestFields(action string, data []byte) (SchemaErrors, error) {
+	schema, err := RequestSchema(action)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	var invalid, fields SchemaErrors
+	schema.validate("$", value, &invalid, &fields)
+	return fields, nil
+}
+
+// checkRequest parses a raw request once to get its action, validate it against the schema for the action and check
+// its fields, returning the action. Unknown and missing fields are errors in strict mode, otherwise they are logged as
+// warnings. Requests with an unknown action are not checked.
+func checkRequest(rawRequest []byte, strict bool) (string, error) {
+	var value interface{}
+	if err := json.Unmarshal(rawRequest, &value); err != nil {
+		return "", fmt.Errorf("error reading request: %s", err)
+	}
+	entries, _ := value.(map[string]interface{})
+	action, _ := entries[matchName("Action", sortedStringKeys(entries))].(string)
+	schema, err := RequestSchema(action)
+	if err != nil {
+		return action, nil
+	}
+	var invalid, fields SchemaErrors
+	schema.validate("$", value, &invalid, &fields)
+	if len(invalid) > 0 {
+		return action, fmt.Errorf("invalid %s request: %s", action, invalid)
+	}
+	if len(fields) > 0 && strict {
+		return action, fmt.Errorf("invalid %s request: %s", action, fields)
+	}
+	for _, problem := range fields {
+		log.Printf("warning: %s request: %s", action, problem)
+	}
+	return action, nil
+}
+
+// suggestFieldName returns the field name closest to key, if it is close enough to be a likely typo.
+func suggestFieldName(key string, names []string) string {
+	best, bestDistance := "", 3
+	for _, name := range names {
+		if distance := editDistance(strings.ToLower(key), strings.ToLower(name)); distance < bestDistance {
+			best, bestDistance = name, distance
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
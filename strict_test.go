@@ -0,0 +1,58 @@
+package common_test
+
+import (
+	"reflect"
+	"testing"
+
+	common "github.com/mergermarket/cdflow2-config-common"
+)
+
+func TestCheckRequestFields(t *testing.T) {
+	// Given
+	request := `{
+		"Action": "prepare_terraform",
+		"Verison": "1",
+		"component": "test-component",
+		"Team": "test-team",
+		"Commit": "test-commit",
+		"EnvName": "live",
+		"Config": {"anything": "goes"},
+		"Env": {},
+		"Colour": "blue"
+	}`
+
+	// When
+	problems, err := common.CheckRequestFields("prepare_terraform", []byte(request))
+	if err != nil {
+		t.Fatal("error checking fields:", err)
+	}
+
+	// Then
+	var actual []string
+	for _, problem := range problems {
+		actual = append(actual, problem.Error())
+	}
+	expected := []string{
+		"$: unknown field Colour",
+		"$: unknown field Verison (did you mean Version?)",
+		"$: missing field Version",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("got %q, wanted %q", actual, expected)
+	}
+}
+
+func TestCheckRequestFieldsNested(t *testing.T) {
+	request := `{
+		"Action": "setup",
+		"Component": "c", "Commit": "c", "Team": "t", "Config": {}, "Env": {},
+		"ReleaseRequirements": {"release": {"Needs": ["lambda"], "Neds": []}}
+	}`
+	problems, err := common.CheckRequestFields("setup", []byte(request))
+	if err != nil {
+		t.Fatal("error checking fields:", err)
+	}
+	if len(problems) != 1 || problems[0].Error() != "$.ReleaseRequirements.release: unknown field Neds (did you mean Needs?)" {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+}